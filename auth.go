@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	gosync "sync"
+)
+
+// client certificate presented to the metadata, log and image servers when
+// built into the initrd
+const (
+	clientCertFile = "/etc/cloudinstall/client.crt"
+	clientKeyFile  = "/etc/cloudinstall/client.key"
+)
+
+// clientCertificates loads the client certificate and key, none if the
+// initrd has no certificate.
+func clientCertificates() []tls.Certificate {
+	if _, err := os.Stat(clientCertFile); err != nil {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		fmt.Printf("failed to load client certificate: %s\n", err)
+		return nil
+	}
+	return []tls.Certificate{cert}
+}
+
+var (
+	tokenMu    gosync.Mutex
+	tokenHosts map[string]bool
+)
+
+// allowToken adds the hosts of urls, the image mirrors of the cloud-config,
+// to those authorize sends the token to.
+func allowToken(urls ...string) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	tokenHostsLocked()
+	for _, rawurl := range urls {
+		if u, err := url.Parse(rawurl); err == nil && u.Host != "" {
+			tokenHosts[strings.ToLower(u.Host)] = true
+		}
+	}
+}
+
+// tokenHostsLocked starts the token hosts with the cloud-config-url host,
+// looked up once as it reads the dmi and the interface mac.
+func tokenHostsLocked() map[string]bool {
+	if tokenHosts != nil {
+		return tokenHosts
+	}
+	tokenHosts = make(map[string]bool)
+	if ok, rawurl := cloudConfigURL(); ok {
+		if u, err := url.Parse(rawurl); err == nil && u.Host != "" {
+			tokenHosts[strings.ToLower(u.Host)] = true
+		}
+	}
+	return tokenHosts
+}
+
+// authorize adds the bearer token given with token= to https requests to the
+// cloud-config-url server and the image mirrors, not to included urls. It is
+// never sent over plain http.
+func authorize(req *http.Request) {
+	ok, token := cmdlineVar("token")
+	if !ok || token == "" {
+		return
+	}
+	tokenMu.Lock()
+	allowed := tokenHostsLocked()[strings.ToLower(req.URL.Host)]
+	tokenMu.Unlock()
+	if !allowed {
+		return
+	}
+	if req.URL.Scheme != "https" {
+		if debug {
+			fmt.Printf("token not sent over %s to %s\n", req.URL.Scheme, req.URL.Host)
+		}
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	saved := cmdline
+	defer func() {
+		cmdline = saved
+		tokenHosts = nil
+	}()
+	cmdline = []string{"token=secret", "cloud-config-url=https://cfg.example.com/{arch}"}
+	tokenHosts = nil
+	allowToken("https://mirror.example.com/images")
+
+	for rawurl, want := range map[string]string{
+		"https://cfg.example.com/x86_64":     "Bearer secret",
+		"https://CFG.example.com/log":        "Bearer secret",
+		"https://mirror.example.com/a.qcow2": "Bearer secret",
+		"http://cfg.example.com/x86_64":      "",
+		"http://mirror.example.com/a.qcow2":  "",
+		"https://include.example.com/cfg":    "",
+		"https://cfg.example.com:8443/":      "",
+	} {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		authorize(req)
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s: got %q, want %q", rawurl, got, want)
+		}
+	}
+}
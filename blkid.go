@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/mitchellh/go-fs"
+	"github.com/mitchellh/go-fs/fat"
+)
+
+// volume is a block device carrying a filesystem the installer can read
+// without mounting it.
+type volume struct {
+	Dev    string
+	FSType string
+	Label  string
+}
+
+// probeVolume detects iso9660 and vfat filesystems and their labels.
+func probeVolume(dev string) (*volume, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if iso, err := openISO9660(f); err == nil {
+		return &volume{Dev: dev, FSType: "iso9660", Label: iso.label}, nil
+	}
+
+	sector := make([]byte, 512)
+	if _, err = f.ReadAt(sector, 0); err != nil {
+		return nil, err
+	}
+	if sector[510] != 0x55 || sector[511] != 0xaa {
+		return nil, fmt.Errorf("%s: unknown filesystem", dev)
+	}
+	// extended boot signature of fat12/16 and fat32
+	switch {
+	case sector[0x26] == 0x29 && string(sector[0x36:0x39]) == "FAT":
+		return &volume{Dev: dev, FSType: "vfat", Label: fatLabel(sector[0x2b:0x36])}, nil
+	case sector[0x42] == 0x29 && string(sector[0x52:0x55]) == "FAT":
+		return &volume{Dev: dev, FSType: "vfat", Label: fatLabel(sector[0x47:0x52])}, nil
+	}
+	return nil, fmt.Errorf("%s: unknown filesystem", dev)
+}
+
+// fatLabel trims the space or NUL padding of a boot sector label.
+func fatLabel(b []byte) string {
+	return strings.TrimRight(string(b), " \x00")
+}
+
+// findVolumes returns the block devices and partitions with a filesystem
+// labelled label, compared case insensitively as vfat labels are upper case.
+func findVolumes(label string) []*volume {
+	var volumes []*volume
+
+	names, _ := filepath.Glob("/sys/class/block/*")
+	for _, name := range names {
+		dev := "/dev/" + filepath.Base(name)
+		v, err := probeVolume(dev)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(v.Label, label) {
+			if debug {
+				fmt.Printf("found %s volume %s on %s\n", v.FSType, v.Label, v.Dev)
+			}
+			volumes = append(volumes, v)
+		}
+	}
+	return volumes
+}
+
+// ReadFile returns the content of the file at the slash separated path.
+func (v *volume) ReadFile(path string) ([]byte, error) {
+	f, err := os.Open(v.Dev)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if v.FSType == "iso9660" {
+		iso, err := openISO9660(f)
+		if err != nil {
+			return nil, err
+		}
+		return iso.ReadFile(path)
+	}
+
+	disk, err := fs.NewFileDisk(f)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := fat.DecodeBootSector(disk)
+	if err != nil {
+		return nil, err
+	}
+	if bs.FATType() == fat.FAT32 {
+		return nil, fmt.Errorf("%s: fat32 is not supported", v.Dev)
+	}
+	vfat := &fatVolume{r: f, bs: bs, fat16: bs.FATType() == fat.FAT16}
+	vfat.table = make([]byte, bs.SectorsPerFat*uint32(bs.BytesPerSector))
+	if _, err = f.ReadAt(vfat.table, int64(bs.FATOffset(0))); err != nil {
+		return nil, err
+	}
+
+	// the fat12/16 root directory is a fixed area before the clusters
+	buf := make([]byte, int(bs.RootEntryCount)*fat.DirectoryEntrySize)
+	if _, err = f.ReadAt(buf, int64(bs.RootDirOffset())); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		var rec *fatRecord
+		records := parseFATDir(buf)
+		for j := range records {
+			if strings.EqualFold(records[j].name, part) {
+				rec = &records[j]
+				break
+			}
+		}
+		if rec == nil {
+			return nil, fmt.Errorf("%s: file not found", path)
+		}
+		if i < len(parts)-1 && !rec.dir {
+			return nil, fmt.Errorf("%s: not a directory", path)
+		}
+		if i == len(parts)-1 && rec.dir {
+			return nil, fmt.Errorf("%s: is a directory", path)
+		}
+		if buf, err = vfat.readChain(rec.cluster); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if !rec.dir {
+			// clusters are read whole, the size is in the directory entry
+			if int64(rec.size) > int64(len(buf)) {
+				return nil, fmt.Errorf("%s: %d bytes in the clusters of a file of %d", path, len(buf), rec.size)
+			}
+			return buf[:rec.size], nil
+		}
+	}
+	return nil, fmt.Errorf("%s: file not found", path)
+}
+
+// fatVolume reads cluster chains of a fat12/16 filesystem. The tables of
+// go-fs mix up the nibbles of fat12 entries.
+type fatVolume struct {
+	r     io.ReaderAt
+	bs    *fat.BootSectorCommon
+	table []byte
+	fat16 bool
+}
+
+// next returns the cluster after c in its chain, 0 at the end.
+func (v *fatVolume) next(c uint32) (uint32, error) {
+	var n, eof uint32
+	if v.fat16 {
+		if int(2*c+1) >= len(v.table) {
+			return 0, fmt.Errorf("cluster %d out of the fat", c)
+		}
+		n, eof = uint32(binary.LittleEndian.Uint16(v.table[2*c:])), 0xfff8
+	} else {
+		off := int(c + c/2)
+		if off+1 >= len(v.table) {
+			return 0, fmt.Errorf("cluster %d out of the fat", c)
+		}
+		n, eof = uint32(binary.LittleEndian.Uint16(v.table[off:])), 0xff8
+		if c&1 == 1 {
+			n >>= 4
+		} else {
+			n &= 0xfff
+		}
+	}
+	switch {
+	case n >= eof:
+		return 0, nil
+	case n < fat.FirstCluster || n == eof-1:
+		return 0, fmt.Errorf("free or bad cluster %d in a chain", n)
+	}
+	return n, nil
+}
+
+// fatRecord is a file or directory of a vfat directory.
+type fatRecord struct {
+	name    string
+	cluster uint32
+	size    uint32
+	dir     bool
+}
+
+// parseFATDir returns the entries of the directory data in buf with their
+// long names if any.
+func parseFATDir(buf []byte) []fatRecord {
+	var records []fatRecord
+	var long []uint16
+	for i := 0; i+fat.DirectoryEntrySize <= len(buf); i += fat.DirectoryEntrySize {
+		b := buf[i : i+fat.DirectoryEntrySize]
+		if b[0] == 0x00 {
+			break
+		}
+		if b[0] == 0xe5 {
+			long = nil
+			continue
+		}
+		attr := fat.DirectoryAttr(b[11])
+		if attr&fat.AttrLongName == fat.AttrLongName {
+			// long name parts come last first, 13 utf-16 chars each
+			var chars []uint16
+			for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars = append(chars, binary.LittleEndian.Uint16(b[off:]))
+			}
+			if b[0]&fat.LastLongEntryMask != 0 {
+				long = nil
+			}
+			long = append(chars, long...)
+			continue
+		}
+		if attr&fat.AttrVolumeId != 0 {
+			long = nil
+			continue
+		}
+
+		rec := fatRecord{
+			cluster: uint32(binary.LittleEndian.Uint16(b[20:]))<<16 | uint32(binary.LittleEndian.Uint16(b[26:])),
+			size:    binary.LittleEndian.Uint32(b[28:]),
+			dir:     attr&fat.AttrDirectory != 0,
+		}
+		if long != nil {
+			// the name ends at a NUL, padded with 0xffff
+			for j, c := range long {
+				if c == 0 {
+					long = long[:j]
+					break
+				}
+			}
+			rec.name = string(utf16.Decode(long))
+			long = nil
+		} else {
+			rec.name = strings.TrimSpace(string(b[0:8]))
+			if ext := strings.TrimSpace(string(b[8:11])); ext != "" {
+				rec.name += "." + ext
+			}
+		}
+		if rec.name != "." && rec.name != ".." {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// readChain reads the clusters of the chain starting at cluster.
+func (v *fatVolume) readChain(cluster uint32) ([]byte, error) {
+	var buf []byte
+	size := v.bs.BytesPerCluster()
+	// a chain longer than the fat has a loop
+	for n := 0; cluster != 0; n++ {
+		if cluster < fat.FirstCluster || n > len(v.table) {
+			return nil, fmt.Errorf("invalid cluster chain")
+		}
+		data := make([]byte, size)
+		if _, err := v.r.ReadAt(data, int64(v.bs.ClusterOffset(int(cluster)))); err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+		next, err := v.next(cluster)
+		if err != nil {
+			return nil, err
+		}
+		cluster = next
+	}
+	return buf, nil
+}
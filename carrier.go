@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	carrierTimeout = 15 * time.Second
+	carrierPoll    = 500 * time.Millisecond
+
+	// rtnetlink multicast group for link state changes
+	rtmgrpLink = 0x1
+)
+
+func hasCarrier(ifname string) bool {
+	buf, err := ioutil.ReadFile("/sys/class/net/" + ifname + "/carrier")
+	return err == nil && strings.TrimSpace(string(buf)) == "1"
+}
+
+// carrierWait returns the carrier timeout, overridable with the dracut
+// rd.net.timeout.carrier=<seconds> parameter.
+func carrierWait() time.Duration {
+	if ok, value := cmdlineVar("rd.net.timeout.carrier"); ok {
+		if sec, err := strconv.Atoi(value); err == nil && sec > 0 {
+			return time.Duration(sec) * time.Second
+		}
+	}
+	return carrierTimeout
+}
+
+func linkSubscribe() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return -1, err
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink}); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// watchCarrier reports each of ifaces once its carrier is up, using netlink
+// link notifications and falling back to polling sysfs. The channel is closed
+// when every interface was reported, done is closed or timeout expires.
+func watchCarrier(ifaces []string, timeout time.Duration, done <-chan struct{}) <-chan string {
+	ch := make(chan string, len(ifaces))
+
+	go func() {
+		defer close(ch)
+
+		pending := make(map[int32]string)
+		for _, ifname := range ifaces {
+			iface, err := net.InterfaceByName(ifname)
+			if err != nil {
+				continue
+			}
+			pending[int32(iface.Index)] = ifname
+		}
+
+		fd, err := linkSubscribe()
+		if err != nil {
+			fd = -1
+		}
+		defer func() {
+			if fd >= 0 {
+				syscall.Close(fd)
+			}
+		}()
+
+		// check the current state only after subscribing so no transition is lost
+		poll := func() {
+			for index, ifname := range pending {
+				if hasCarrier(ifname) {
+					ch <- ifname
+					delete(pending, index)
+				}
+			}
+		}
+		poll()
+
+		deadline := time.Now().Add(timeout)
+		buf := make([]byte, syscall.Getpagesize())
+		for len(pending) > 0 {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			left := deadline.Sub(time.Now())
+			if left <= 0 {
+				return
+			}
+			if left > carrierPoll {
+				left = carrierPoll
+			}
+
+			if fd < 0 {
+				time.Sleep(left)
+				poll()
+				continue
+			}
+
+			tv := syscall.NsecToTimeval(left.Nanoseconds())
+			syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err != syscall.EAGAIN && err != syscall.EINTR {
+					syscall.Close(fd)
+					fd = -1
+				}
+				continue
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				if m.Header.Type != syscall.RTM_NEWLINK || len(m.Data) < syscall.SizeofIfInfomsg {
+					continue
+				}
+				info := nl.DeserializeIfInfomsg(m.Data)
+				ifname, ok := pending[info.Index]
+				if ok && info.Flags&syscall.IFF_RUNNING != 0 {
+					ch <- ifname
+					delete(pending, info.Index)
+				}
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// installDevice is the disk the image is written to.
+const installDevice = "/dev/sda"
+
+const cliUsage = `usage: cloudinstall [-debug] validate <cloud-config>...
+       cloudinstall [-debug] render <cloud-config>
+       cloudinstall init
+
+validate checks the given user-data files, render also prints the image,
+fetch urls and the actions the installer would take. Use - for stdin.
+init runs the installer as the initrd does, it overwrites ` + installDevice + `.
+`
+
+// initMode is true when the binary runs as the installer: as pid 1 or with
+// the init argument, the init script pipes it through tee so it is not pid
+// 1 there. Anything else is a command and never touches the disk.
+func initMode() bool {
+	if os.Getpid() == 1 {
+		return true
+	}
+	for _, arg := range os.Args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		return arg == "init"
+	}
+	return false
+}
+
+func imageName(b Bootstrap) string {
+	return fmt.Sprintf("%s-%s-%s", b.Name, b.Version, b.Arch)
+}
+
+func osType(b Bootstrap) string {
+	switch {
+	case strings.Contains(b.Name, "ispdn"):
+		return "ispdn"
+	case strings.Contains(b.Name, "bsd"):
+		return "bsd"
+	}
+	return "linux"
+}
+
+func runCLI(args []string) int {
+	flags := flag.NewFlagSet("cloudinstall", flag.ContinueOnError)
+	flags.BoolVar(&debug, "debug", false, "print debug output")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, cliUsage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	args = flags.Args()
+	if len(args) < 2 {
+		flags.Usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "validate":
+		status := 0
+		for _, name := range args[1:] {
+			if _, err := readCloudConfig(name); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+				status = 1
+				continue
+			}
+			fmt.Printf("%s: ok\n", name)
+		}
+		return status
+	case "render":
+		if len(args) != 2 {
+			flags.Usage()
+			return 2
+		}
+		cloudConfig, err := readCloudConfig(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", args[1], err)
+			return 1
+		}
+		render(cloudConfig)
+		return 0
+	}
+	flags.Usage()
+	return 2
+}
+
+func readCloudConfig(name string) (CloudConfig, error) {
+	var buf []byte
+	var err error
+	if name == "-" {
+		buf, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return CloudConfig{}, err
+	}
+	cloudConfig, err := parseUserdata(buf)
+	if errs, ok := err.(configErrors); ok && len(errs) > 1 {
+		var lines []string
+		for _, e := range errs {
+			lines = append(lines, e.Error())
+		}
+		err = fmt.Errorf("%d errors:\n  %s", len(errs), strings.Join(lines, "\n  "))
+	}
+	return cloudConfig, err
+}
+
+// render prints what main would do with cloudConfig.
+func render(cloudConfig CloudConfig) {
+	b := cloudConfig.Bootstrap
+	img := imageName(b)
+
+	fmt.Printf("image: %s\n", img)
+	fmt.Printf("fetch:\n")
+	for _, fetchaddr := range b.Fetch {
+		fmt.Printf("  %s/%s\n", fetchaddr, img)
+	}
+	if proxy, err := parseProxy(imageProxy(b)); err == nil && proxy != nil {
+		// credentials stay out of the output
+		proxy.User = nil
+		fmt.Printf("proxy: %s\n", proxy)
+	}
+
+	fmt.Printf("actions:\n")
+	if b.Timeout != "" {
+		dt, _ := time.ParseDuration(b.Timeout)
+		fmt.Printf("  - fail the install after %s\n", dt)
+	}
+	fmt.Printf("  - write %s to %s\n", img, installDevice)
+
+	ostype := osType(b)
+	if ostype == "linux" {
+		fmt.Printf("  - grow the first partition of %s to the whole disk unless cloudinit=true\n", installDevice)
+		fmt.Printf("  - resize the ext4 or btrfs root filesystem\n")
+		for _, user := range cloudConfig.Users {
+			switch {
+			case user.Passwd != "":
+				fmt.Printf("  - set the encrypted password of %s\n", user.Name)
+			case user.PlainPasswd != "":
+				fmt.Printf("  - set the plain text password of %s\n", user.Name)
+			}
+		}
+	} else {
+		fmt.Printf("  - leave the %s image as written\n", ostype)
+	}
+	fmt.Printf("  - report install success and power off\n")
+}
@@ -1,15 +1,17 @@
 package main
 
 type User struct {
-	Name   string   `yaml:"name,omitempty"`
-	Passwd string   `yaml:"passwd,omitempty"`
-	SSHKey []string `yaml:"ssh-authorized-keys,omitempty"`
+	Name        string   `yaml:"name,omitempty"`
+	Passwd      string   `yaml:"passwd,omitempty"`
+	PlainPasswd string   `yaml:"plain_text_passwd,omitempty"`
+	SSHKey      []string `yaml:"ssh-authorized-keys,omitempty"`
 }
 
 type Bootstrap struct {
 	Name     string   `yaml:"name"`
 	Arch     string   `yaml:"arch"`
 	Fetch    []string `yaml:"fetch"`
+	Proxy    string   `yaml:"proxy,omitempty"`
 	Version  string   `yaml:"version"`
 	Resize   bool     `yaml:"resize,omitempty"`
 	Timeout  string   `yaml:"timeout,omitempty"`
@@ -23,6 +25,7 @@ type CloudConfig struct {
 	AllowRootLogin bool      `yaml:"disable_root,omitempty"`
 	AllowRootSSH   bool      `yaml:"ssh_pwauth,omitempty"`
 	AllowResize    bool      `yaml:"resize_rootfs,omitempty"`
+	Hostname       string    `yaml:"hostname,omitempty"`
 	Users          []User    `yaml:"users,omitempty"`
 	Bootstrap      Bootstrap `yaml:"bootstrap,omitempty"`
 }
@@ -37,4 +40,7 @@ type DataSource struct {
 	Datasource struct {
 		Ec2 Ec2 `yaml:"Ec2,omitempty"`
 	} `yaml:"datasource"`
+
+	// body of cloud-config-url, read once as datasource and user-data
+	userdata []byte
 }
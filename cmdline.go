@@ -28,3 +28,13 @@ func cmdlineBool(key string) (ok bool) {
 	}
 	return false
 }
+
+func cmdlineVars(key string) (values []string) {
+	for _, token := range cmdline {
+		parts := strings.SplitN(token, "=", 2)
+		if key == strings.TrimSpace(parts[0]) && len(parts) == 2 {
+			values = append(values, parts[1])
+		}
+	}
+	return
+}
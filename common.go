@@ -37,6 +37,7 @@ func unmount(target string, flags int) (err error) {
 }
 
 func reboot() error {
+	releaseLeases()
 	return syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
 }
 
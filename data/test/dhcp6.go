@@ -0,0 +1,203 @@
+// dhcp6 is a test harness for the installer ipv6 configuration. It creates a
+// veth pair, answers router solicitations with the managed flag set and runs
+// an in-process dhcpv6 responder on the server end. The command given after
+// the flags is run with the client end name in CLIENT_IFACE and the pair is
+// removed once it exits:
+//
+//	go run data/test/dhcp6.go -prefix 2001:db8:1:: -- ip -6 addr show dev ci0
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+var (
+	srvIface = flag.String("server", "ci1", "server end of the veth pair")
+	cliIface = flag.String("client", "ci0", "client end of the veth pair")
+	prefix   = flag.String("prefix", "2001:db8:1::", "/64 prefix to lease addresses from")
+	dns      = flag.String("dns", "2001:db8::53", "dns server to hand out")
+	domain   = flag.String("domain", "example.com", "search domain to hand out")
+	managed  = flag.Bool("managed", true, "set the managed flag in router advertisements")
+)
+
+func main() {
+	flag.Parse()
+
+	run(exec.Command("ip", "link", "add", *cliIface, "type", "veth", "peer", "name", *srvIface))
+	defer exec.Command("ip", "link", "del", *cliIface).Run()
+	run(exec.Command("ip", "link", "set", *srvIface, "up"))
+	run(exec.Command("ip", "link", "set", *cliIface, "up"))
+	time.Sleep(3 * time.Second)
+
+	iface, err := net.InterfaceByName(*srvIface)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go routerAdvertiser(iface)
+	go dhcp6Responder(iface)
+
+	if flag.NArg() == 0 {
+		select {}
+	}
+
+	cmd := exec.Command(flag.Arg(0), flag.Args()[1:]...)
+	cmd.Env = append(os.Environ(), "CLIENT_IFACE="+*cliIface)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		log.Printf("client: %s", err)
+		exec.Command("ip", "link", "del", *cliIface).Run()
+		os.Exit(1)
+	}
+}
+
+func run(cmd *exec.Cmd) {
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Fatalf("%s: %s %s", cmd.Args, err, out)
+	}
+}
+
+func routerAdvertiser(iface *net.Interface) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		log.Fatal(err)
+	}
+	syscall.BindToDevice(fd, iface.Name)
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255)
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index)
+
+	mreq := &syscall.IPv6Mreq{Interface: uint32(iface.Index)}
+	copy(mreq.Multiaddr[:], net.ParseIP("ff02::2"))
+	if err = syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq); err != nil {
+		log.Fatal(err)
+	}
+
+	flags := byte(0)
+	if *managed {
+		flags |= 0x80
+	}
+	ra := []byte{134, 0, 0, 0, 64, flags, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0, 0}
+	// prefix information, on-link only so addresses come from dhcpv6
+	pi := []byte{3, 4, 64, 0x80, 0, 0, 0x0e, 0x10, 0, 0, 0x0e, 0x10, 0, 0, 0, 0}
+	pi = append(pi, net.ParseIP(*prefix).To16()...)
+	ra = append(ra, pi...)
+
+	dst := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(dst.Addr[:], net.ParseIP("ff02::1"))
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n < 1 || buf[0] != 133 {
+			continue
+		}
+		log.Printf("router solicitation on %s", iface.Name)
+		if err = syscall.Sendto(fd, ra, 0, dst); err != nil {
+			log.Printf("ra: %s", err)
+		}
+	}
+}
+
+func option(b []byte, code uint16, data []byte) []byte {
+	var hdr [4]byte
+	binary.BigEndian.PutUint16(hdr[0:2], code)
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(data)))
+	return append(append(b, hdr[:]...), data...)
+}
+
+func dhcp6Responder(iface *net.Interface) {
+	conn, err := net.ListenMulticastUDP("udp6", iface, &net.UDPAddr{IP: net.ParseIP("ff02::1:2"), Port: 547})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serverID := append([]byte{0, 3, 0, 1}, iface.HardwareAddr...)
+	var next byte = 0x10
+
+	leases := make(map[string]net.IP)
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		msg := buf[:n]
+		if len(msg) < 4 || (msg[0] != 1 && msg[0] != 3) {
+			continue
+		}
+
+		var clientID, iana []byte
+		for opts := msg[4:]; len(opts) >= 4; {
+			code := binary.BigEndian.Uint16(opts[0:2])
+			olen := int(binary.BigEndian.Uint16(opts[2:4]))
+			if 4+olen > len(opts) {
+				break
+			}
+			switch code {
+			case 1:
+				clientID = opts[4 : 4+olen]
+			case 2:
+				if !bytes.Equal(opts[4:4+olen], serverID) {
+					clientID = nil
+				}
+			case 3:
+				iana = opts[4 : 4+olen]
+			}
+			opts = opts[4+olen:]
+		}
+		if clientID == nil || len(iana) < 12 {
+			continue
+		}
+
+		ip, ok := leases[string(clientID)]
+		if !ok {
+			ip = make(net.IP, net.IPv6len)
+			copy(ip, net.ParseIP(*prefix).To16())
+			ip[15] = next
+			next++
+			leases[string(clientID)] = ip
+		}
+
+		typ := byte(2)
+		if msg[0] == 3 {
+			typ = 7
+		}
+		reply := []byte{typ, msg[1], msg[2], msg[3]}
+		reply = option(reply, 1, clientID)
+		reply = option(reply, 2, serverID)
+
+		ia := make([]byte, 12)
+		copy(ia[0:4], iana[0:4])
+		binary.BigEndian.PutUint32(ia[4:8], 1800)
+		binary.BigEndian.PutUint32(ia[8:12], 2880)
+		addr := make([]byte, 24)
+		copy(addr, ip)
+		binary.BigEndian.PutUint32(addr[16:20], 3600)
+		binary.BigEndian.PutUint32(addr[20:24], 7200)
+		reply = option(reply, 3, option(ia, 5, addr))
+		reply = option(reply, 23, net.ParseIP(*dns).To16())
+
+		var dl []byte
+		for _, label := range bytes.Split([]byte(*domain), []byte(".")) {
+			dl = append(append(dl, byte(len(label))), label...)
+		}
+		reply = option(reply, 24, append(dl, 0))
+
+		log.Printf("dhcpv6 message %d from %s, offering %s", msg[0], src, ip)
+		if _, err = conn.WriteToUDP(reply, src); err != nil {
+			log.Printf("reply: %s", err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// ec2 is a fake ec2 metadata service for testing the installer datasource.
+// It serves a small meta-data tree and the given user-data file below
+// /latest, optionally answering 503 for the first requests to exercise
+// the MaxWait handling:
+//
+//	go run data/test/ec2.go -listen 127.0.0.1:8169 -userdata cloud-config.yaml
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	listen   = flag.String("listen", "127.0.0.1:8169", "address to serve the metadata service on")
+	userdata = flag.String("userdata", "", "file served as user-data, 404 if empty")
+	fail     = flag.Int("fail", 0, "answer the first n requests with 503")
+)
+
+var metadata = map[string]string{
+	"ami-id":                      "ami-12345678",
+	"instance-id":                 "i-0123456789abcdef0",
+	"instance-type":               "m1.small",
+	"local-hostname":              "ip-10-0-0-2.ec2.internal",
+	"local-ipv4":                  "10.0.0.2",
+	"placement/availability-zone": "us-east-1a",
+	"public-keys/0/openssh-key":   "ssh-rsa AAAAB3NzaC1yc2E test@example",
+	"network/interfaces/macs/02:00:00:00:00:01/device-number": "0",
+}
+
+func main() {
+	flag.Parse()
+
+	var mu sync.Mutex
+	failed := 0
+
+	http.HandleFunc("/latest/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if failed < *fail {
+			failed++
+			mu.Unlock()
+			log.Printf("%s %s 503", r.Method, r.URL.Path)
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		mu.Unlock()
+		log.Printf("%s %s", r.Method, r.URL.Path)
+
+		path := strings.TrimPrefix(r.URL.Path, "/latest/")
+		switch {
+		case path == "user-data":
+			if *userdata == "" {
+				http.NotFound(w, r)
+				return
+			}
+			buf, err := ioutil.ReadFile(*userdata)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write(buf)
+		case strings.HasPrefix(path, "meta-data/"):
+			serveMetadata(w, r, strings.TrimPrefix(path, "meta-data/"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+// serveMetadata answers a leaf with its value and a directory with the
+// listing of its children, public-keys in the index=name form.
+func serveMetadata(w http.ResponseWriter, r *http.Request, path string) {
+	if value, ok := metadata[path]; ok {
+		w.Write([]byte(value))
+		return
+	}
+
+	children := make(map[string]bool)
+	for key := range metadata {
+		if !strings.HasPrefix(key, path) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, path)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			rest = rest[:i+1]
+		}
+		if path == "public-keys/" {
+			rest = strings.TrimSuffix(rest, "/") + "=test"
+		}
+		children[rest] = true
+	}
+	if len(children) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var list []string
+	for child := range children {
+		list = append(list, child)
+	}
+	sort.Strings(list)
+	w.Write([]byte(strings.Join(list, "\n")))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Datasource provides instance metadata and the user-data holding the
+// cloud-config of the installer.
+type Datasource interface {
+	Type() string
+	FetchMetadata() (map[string]string, error)
+	FetchUserdata() ([]byte, error)
+}
+
+// metadata of the datasource the cloud-config was read from.
+var metadata map[string]string
+
+// dsParam parses the ds=<name>[;<key>=<value>...] kernel parameter.
+func dsParam() (name string, params map[string]string) {
+	params = make(map[string]string)
+
+	ok, value := cmdlineVar("ds")
+	if !ok {
+		return "", params
+	}
+	fields := strings.Split(value, ";")
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		} else {
+			params[kv[0]] = ""
+		}
+	}
+	return strings.ToLower(fields[0]), params
+}
+
+// waitForURL polls base+path for each of bases until one answers, backing
+// off up to maxWait, and returns that base.
+func waitForURL(client *http.Client, bases []string, path string, maxWait time.Duration) (string, error) {
+	deadline := time.Now().Add(maxWait)
+	delay := time.Second
+	for {
+		for _, base := range bases {
+			res, err := fetch(client, "GET", base+path, 1)
+			if err != nil {
+				if debug {
+					fmt.Printf("wait %s: %s\n", base, err)
+				}
+				continue
+			}
+			res.Body.Close()
+			return base, nil
+		}
+
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return "", fmt.Errorf("no metadata service at %s after %s", strings.Join(bases, ", "), maxWait)
+		}
+		if delay > left {
+			delay = left
+		}
+		time.Sleep(delay)
+		if delay < 10*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// applyMetadata fills hostname, ssh keys and the root password from
+// datasource metadata into cloudConfig unless the user-data sets them.
+func applyMetadata(md map[string]string, cloudConfig *CloudConfig) {
+	if cloudConfig.Hostname == "" {
+		if name, ok := md["hostname"]; ok {
+			cloudConfig.Hostname = name
+		} else {
+			cloudConfig.Hostname = md["local-hostname"]
+		}
+	}
+
+	var paths []string
+	for path := range md {
+		if strings.HasPrefix(path, "public-keys/") {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	password := md["admin_pass"]
+	if len(paths) == 0 && password == "" {
+		return
+	}
+
+	var root *User
+	for i := range cloudConfig.Users {
+		if cloudConfig.Users[i].Name == "root" {
+			root = &cloudConfig.Users[i]
+		}
+	}
+	if root == nil {
+		cloudConfig.Users = append(cloudConfig.Users, User{Name: "root"})
+		root = &cloudConfig.Users[len(cloudConfig.Users)-1]
+	}
+
+keys:
+	for _, path := range paths {
+		key := strings.TrimSpace(md[path])
+		for _, k := range root.SSHKey {
+			if k == key {
+				continue keys
+			}
+		}
+		root.SSHKey = append(root.SSHKey, key)
+	}
+	if password != "" && root.Passwd == "" && root.PlainPasswd == "" {
+		root.PlainPasswd = password
+	}
+}
+
+// urlDatasource reads the cloud-config from the cloud-config-url parameter,
+// body holds it if getDataSource already read it.
+type urlDatasource struct {
+	url  string
+	body []byte
+}
+
+func (u *urlDatasource) Type() string {
+	return "url"
+}
+
+func (u *urlDatasource) FetchMetadata() (map[string]string, error) {
+	return nil, nil
+}
+
+func (u *urlDatasource) FetchUserdata() ([]byte, error) {
+	if u.body != nil {
+		return u.body, nil
+	}
+	return httpGet(newHTTPClient(10*time.Second), u.url)
+}
+
+// datasources returns the datasources to try in order. A config-2 drive
+// comes first, then the nocloud seed url given with ds=nocloud-net;s=<url>
+// and a cidata volume, then the metadata services asked for with ds= or
+// configured in dataSource and cloud-config-url. Without any of them the
+// default ec2 address is probed.
+func datasources(dataSource DataSource) []Datasource {
+	var sources []Datasource
+
+	name, params := dsParam()
+	ec2 := dataSource.Datasource.Ec2
+	if urls, ok := params["metadata_urls"]; ok && (name == "ec2" || name == "openstack") {
+		ec2.MetadataUrls = strings.Split(urls, ",")
+	}
+
+	if name == "" || name == "configdrive" {
+		if volumes := findVolumes(configDriveLabel); len(volumes) > 0 {
+			sources = append(sources, &configDriveDatasource{volumes: volumes})
+		}
+	}
+	nocloud := name == "nocloud" || name == "nocloud-net"
+	if seed, ok := params["s"]; ok && nocloud {
+		sources = append(sources, newNocloudNetDatasource(seed, params))
+	} else if seed, ok := params["seedfrom"]; ok && nocloud {
+		sources = append(sources, newNocloudNetDatasource(seed, params))
+	}
+	if name == "" || nocloud {
+		if volumes := findVolumes(nocloudLabel); len(volumes) > 0 {
+			sources = append(sources, &nocloudDatasource{volumes: volumes, params: params})
+		}
+	}
+	switch {
+	case name == "openstack":
+		sources = append(sources, newOpenstackDatasource(ec2))
+	case name == "ec2" || len(ec2.MetadataUrls) > 0:
+		sources = append(sources, newEc2Datasource(ec2))
+	}
+	if ok, rawurl := cloudConfigURL(); ok {
+		sources = append(sources, &urlDatasource{url: rawurl, body: dataSource.userdata})
+	}
+	if len(sources) == 0 && name == "" {
+		sources = append(sources, newEc2Datasource(ec2))
+	}
+	return sources
+}
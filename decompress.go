@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+
+	"github.com/biogo/hts/bgzf"
+	pgzip "github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4"
+	"github.com/xi2/xz"
+	"github.com/yoctocloud/cloudinstall/zstd"
+)
+
+// comptype values of the image metadata, qcow2, vmdk and vhd images are not
+// a stream and written by writeQcow2, writeVmdk and writeVhd
+const (
+	compBgzf  = "bgzf"
+	compPgzip = "pgzip"
+	compGzip  = "gzip"
+	compZstd  = "zstd" // windows up to zstd.MaxWindowSize, --long=27
+	compXz    = "xz"
+	compLz4   = "lz4"
+	compBzip2 = "bzip2"
+	compQcow2 = "qcow2"
+	compVmdk  = "vmdk"
+	compVhd   = "vhd"
+)
+
+var compMagics = []struct {
+	comptype string
+	magic    []byte
+}{
+	{compZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{compXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{compLz4, []byte{0x04, 0x22, 0x4d, 0x18}},
+	{compBzip2, []byte("BZh")},
+	{compQcow2, []byte(qcow2Magic)},
+	{compVmdk, []byte(vmdkMagic)},
+	{compVhd, []byte(vhdCookie)},
+	{compPgzip, []byte{0x1f, 0x8b}},
+}
+
+// detectCompression returns the comptype of the image in br from its magic
+// bytes without consuming them. Gzip members with the BC extra subfield are
+// bgzf, other gzip streams are read with pgzip.
+func detectCompression(br *bufio.Reader) (string, error) {
+	head, err := br.Peek(16)
+	if len(head) == 0 {
+		return "", err
+	}
+	for _, c := range compMagics {
+		if !bytes.HasPrefix(head, c.magic) {
+			continue
+		}
+		if c.comptype == compPgzip && len(head) == 16 && head[3]&0x04 != 0 && head[12] == 'B' && head[13] == 'C' {
+			return compBgzf, nil
+		}
+		return c.comptype, nil
+	}
+	return "", fmt.Errorf("unknown image compression, magic %x", head)
+}
+
+// decompressor returns a reader of the image in r compressed with comptype.
+func decompressor(comptype string, r io.Reader) (io.ReadCloser, error) {
+	switch comptype {
+	case compBgzf:
+		br, err := bgzf.NewReader(r, runtime.NumCPU())
+		if err != nil {
+			return nil, err
+		}
+		return br, nil
+	case compPgzip:
+		return pgzip.NewReader(r)
+	case compGzip:
+		return gzip.NewReader(r)
+	case compZstd:
+		return ioutil.NopCloser(zstd.NewReader(r)), nil
+	case compXz:
+		xr, err := xz.NewReader(r, 0)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case compLz4:
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	case compBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unknown comptype %s", comptype)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/biogo/hts/bgzf"
+	"github.com/pierrec/lz4"
+)
+
+const testPlain = "hello, world\n"
+
+// testCompressed holds testPlain compressed with the zstd, xz and bzip2
+// commands, which have no compressor in go, and with the writers of gzip,
+// bgzf and lz4.
+func testCompressed(t *testing.T) map[string][]byte {
+	c := map[string][]byte{
+		compZstd: []byte("\x28\xb5\x2f\xfd\x24\x0d\x69\x00\x00\x68\x65\x6c\x6c\x6f\x2c\x20\x77\x6f\x72\x6c\x64\x0a\x4c\x1f\xf9\xf1"),
+		compXz: []byte("\xfd\x37\x7a\x58\x5a\x00\x00\x01\x69\x22\xde\x36\x04\xc0\x11\x0d\x21\x01\x16\x00\x00\x00\x00\x00\x00\x00\x00\x00\x88\x88\xcd\x68" +
+			"\x01\x00\x0c\x68\x65\x6c\x6c\x6f\x2c\x20\x77\x6f\x72\x6c\x64\x0a\x00\x00\x00\x00\x53\x74\x24\xf4\x00\x01\x29\x0d\x7d\x56\x71\x1a" +
+			"\x90\x42\x99\x0d\x01\x00\x00\x00\x00\x01\x59\x5a"),
+		compBzip2: []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x54\xa4\x97\x84\x00\x00\x02\xd1\x80\x00\x10\x40\x04\x06\x44\x90\x80\x20\x00\x31\x00\x30" +
+			"\x20\x68\x62\x00\x49\xd4\xb2\x1f\x3f\x17\x72\x45\x38\x50\x90\x54\xa4\x97\x84"),
+	}
+
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	gw.Write([]byte(testPlain))
+	gw.Close()
+	c[compPgzip] = append([]byte(nil), b.Bytes()...)
+	c[compGzip] = c[compPgzip]
+
+	b.Reset()
+	bw := bgzf.NewWriter(&b, 1)
+	bw.Write([]byte(testPlain))
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c[compBgzf] = append([]byte(nil), b.Bytes()...)
+
+	b.Reset()
+	lw := lz4.NewWriter(&b)
+	lw.Write([]byte(testPlain))
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c[compLz4] = append([]byte(nil), b.Bytes()...)
+	return c
+}
+
+func TestDetectCompression(t *testing.T) {
+	compressed := testCompressed(t)
+	for _, tt := range []struct {
+		in   []byte
+		want string
+	}{
+		{compressed[compZstd], compZstd},
+		{compressed[compXz], compXz},
+		{compressed[compLz4], compLz4},
+		{compressed[compBzip2], compBzip2},
+		{compressed[compBgzf], compBgzf},
+		{compressed[compPgzip], compPgzip},
+		{[]byte(qcow2Magic + "\x00\x00\x00\x03"), compQcow2},
+		{[]byte(vmdkMagic + "\x03\x00\x00\x00"), compVmdk},
+		{[]byte(vhdCookie + "\x00\x00\x00\x02"), compVhd},
+		// a gzip member too short for the extra field
+		{[]byte{0x1f, 0x8b, 0x08, 0x04}, compPgzip},
+		{[]byte("hello"), ""},
+		{nil, ""},
+	} {
+		br := bufio.NewReader(bytes.NewReader(tt.in))
+		got, err := detectCompression(br)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("detectCompression(%x) = %q, %v, want %q", tt.in, got, err, tt.want)
+			continue
+		}
+		// the magic is left for the decompressor
+		if rest, _ := ioutil.ReadAll(br); !bytes.Equal(rest, tt.in) {
+			t.Errorf("detectCompression(%x) consumed input", tt.in)
+		}
+	}
+}
+
+func TestDecompressor(t *testing.T) {
+	compressed := testCompressed(t)
+	for _, comptype := range []string{compZstd, compXz, compLz4, compBzip2, compBgzf, compPgzip, compGzip} {
+		rc, err := decompressor(comptype, bytes.NewReader(compressed[comptype]))
+		if err != nil {
+			t.Errorf("%s: %s", comptype, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(got) != testPlain {
+			t.Errorf("%s: got %q, %v", comptype, got, err)
+		}
+	}
+
+	// the stream is checked against the comptype
+	for _, comptype := range []string{compXz, compBgzf, compPgzip, compGzip} {
+		rc, err := decompressor(comptype, bytes.NewReader(compressed[compZstd]))
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, rc)
+			rc.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: zstd data accepted", comptype)
+		}
+	}
+	if _, err := decompressor(compQcow2, bytes.NewReader(nil)); err == nil {
+		t.Errorf("qcow2 is not a stream")
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/d2g/dhcp4"
+	"github.com/d2g/dhcp4client"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	dhcp4OptionClientUUID   = 97
+	dhcp4OptionDomainSearch = 119
+
+	dhcp4VendorClass = "cloudinstall"
+
+	dhcp4Timeout = 8 * time.Second
+)
+
+var (
+	// publicNameservers are used by a bare fallback-dns parameter.
+	publicNameservers = []net.IP{net.IPv4(8, 8, 8, 8), net.IPv4(8, 8, 4, 4)}
+
+	// ntpServers holds time servers learned from dhcp option 42.
+	ntpServers []net.IP
+)
+
+var dhcp4RequestParams = []byte{
+	byte(dhcp4.OptionSubnetMask),
+	byte(dhcp4.OptionRouter),
+	byte(dhcp4.OptionDomainNameServer),
+	byte(dhcp4.OptionDomainName),
+	byte(dhcp4.OptionInterfaceMTU),
+	byte(dhcp4.OptionNetworkTimeProtocolServers),
+	dhcp4OptionDomainSearch,
+	byte(dhcp4.OptionClasslessRouteFormat),
+}
+
+// dhcp4Identity returns the options that let dhcp servers recognise the
+// installer: vendor class cloudinstall:<arch>, the client identifier from
+// dhcp-client-id=, the hostname and the smbios system uuid.
+func dhcp4Identity() []dhcp4.Option {
+	var opts []dhcp4.Option
+
+	if arch := machineArch(); arch != "" {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte(dhcp4VendorClass + ":" + arch)})
+	}
+
+	if ok, value := cmdlineVar("dhcp-client-id"); ok && value != "" && value != "dhcp-client-id" {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionClientIdentifier, Value: parseClientID(value)})
+	}
+
+	hostname := ""
+	if ok, value := cmdlineVar("hostname"); ok && value != "hostname" {
+		hostname = value
+	} else if name, err := os.Hostname(); err == nil && name != "(none)" && name != "localhost" {
+		hostname = name
+	}
+	if hostname != "" && len(hostname) < 256 {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte(hostname)})
+	}
+
+	if uuid, err := parseUUID(productUUID()); err == nil {
+		// the kernel prints the uuid in rfc 4122 order, pxe clients send
+		// the first three fields little endian as stored by smbios
+		uuid[0], uuid[1], uuid[2], uuid[3] = uuid[3], uuid[2], uuid[1], uuid[0]
+		uuid[4], uuid[5] = uuid[5], uuid[4]
+		uuid[6], uuid[7] = uuid[7], uuid[6]
+		opts = append(opts, dhcp4.Option{Code: dhcp4OptionClientUUID, Value: append([]byte{0}, uuid...)})
+	}
+	return opts
+}
+
+// parseClientID accepts a colon separated hex string like 01:52:54:00:12:34:56,
+// sent as is, or any other string sent with type 0.
+func parseClientID(s string) []byte {
+	if b, err := hex.DecodeString(strings.Replace(s, ":", "", -1)); err == nil && strings.Contains(s, ":") && len(b) > 1 {
+		return b
+	}
+	return append([]byte{0}, s...)
+}
+
+func addDHCP4Options(p *dhcp4.Packet, opts []dhcp4.Option) {
+	for _, opt := range opts {
+		p.AddOption(opt.Code, opt.Value)
+	}
+}
+
+type dhcp4Route struct {
+	Dst net.IPNet
+	Gw  net.IP
+}
+
+type dhcp4Lease struct {
+	IP      net.IPNet
+	Routers []net.IP
+	Routes  []dhcp4Route
+	DNS     []net.IP
+	Search  []string
+	MTU     int
+	NTP     []net.IP
+}
+
+type dhcp4Result struct {
+	ifname string
+	link   netlink.Link
+	client *dhcp4client.Client
+	ack    dhcp4.Packet
+	lease  *dhcp4Lease
+	err    error
+}
+
+// dhcp4Conn wraps the raw packet socket of dhcp4client, which sees every
+// ipv4 packet on the link, and only passes bootp replies up to the client.
+type dhcp4Conn struct {
+	conn interface {
+		Close() error
+		Write(packet []byte) error
+		ReadFrom() ([]byte, net.IP, error)
+		SetReadTimeout(t time.Duration) error
+	}
+	deadline time.Time
+}
+
+func newDHCP4Conn(ifindex int) (*dhcp4Conn, error) {
+	conn, err := dhcp4client.NewPacketSock(ifindex)
+	if err != nil {
+		return nil, err
+	}
+	return &dhcp4Conn{conn: conn}, nil
+}
+
+func (c *dhcp4Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *dhcp4Conn) Write(packet []byte) error {
+	return c.conn.Write(packet)
+}
+
+func (c *dhcp4Conn) SetReadTimeout(t time.Duration) error {
+	c.deadline = time.Now().Add(t)
+	return c.conn.SetReadTimeout(t)
+}
+
+func (c *dhcp4Conn) ReadFrom() ([]byte, net.IP, error) {
+	cookie := []byte{99, 130, 83, 99}
+	for {
+		b, src, err := c.conn.ReadFrom()
+		if err != nil {
+			return b, src, err
+		}
+		p := dhcp4.Packet(b)
+		if len(p) > 240 && p.OpCode() == dhcp4.BootReply && bytes.Equal(p.Cookie(), cookie) {
+			return b, src, nil
+		}
+		left := c.deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, nil, syscall.EAGAIN
+		}
+		if err = c.conn.SetReadTimeout(left); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// dhcp4Attempt requests a lease on ifname without configuring it.
+func dhcp4Attempt(ifname string) (res dhcp4Result) {
+	res.ifname = ifname
+
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		res.err = err
+		return
+	}
+	res.link, err = netlink.LinkByName(ifname)
+	if err != nil {
+		res.err = err
+		return
+	}
+
+	flushAddr([]string{ifname}, "ipv4")
+	routes, err := netlink.RouteList(res.link, netlink.FAMILY_V4)
+	if err == nil {
+		for _, route := range routes {
+			if debug {
+				fmt.Printf("try to remove route %s\n", route)
+			}
+			netlink.RouteDel(&route)
+		}
+	}
+
+	conn, err := newDHCP4Conn(iface.Index)
+	if err != nil {
+		res.err = fmt.Errorf("can't create dhcp4 socket on %s: %s", ifname, err)
+		return
+	}
+	client, err := dhcp4client.New(dhcp4client.HardwareAddr(iface.HardwareAddr), dhcp4client.Timeout(dhcp4Timeout), dhcp4client.Connection(conn))
+	if err != nil {
+		conn.Close()
+		res.err = fmt.Errorf("can't create dhcp4 client on %s", ifname)
+		return
+	}
+
+	ok, packet, err := dhcp4Exchange(client)
+	if !ok || err != nil {
+		client.Close()
+		res.err = fmt.Errorf("can't do dhcp request on %s", ifname)
+		return
+	}
+
+	res.lease, err = parseDHCP4Lease(packet)
+	if err != nil {
+		client.Close()
+		res.err = err
+		return
+	}
+	res.client = client
+	res.ack = packet
+	return
+}
+
+// dhcp4Exchange performs discover/offer/request/ack like client.Request but
+// asks the server for the options the installer understands.
+func dhcp4Exchange(client *dhcp4client.Client) (bool, dhcp4.Packet, error) {
+	identity := dhcp4Identity()
+
+	discover := client.DiscoverPacket()
+	discover.AddOption(dhcp4.OptionParameterRequestList, dhcp4RequestParams)
+	addDHCP4Options(&discover, identity)
+	discover.PadToMinSize()
+	if err := client.SendPacket(discover); err != nil {
+		return false, discover, err
+	}
+
+	offer, err := client.GetOffer(&discover)
+	if err != nil {
+		return false, offer, err
+	}
+
+	request := client.RequestPacket(&offer)
+	request.AddOption(dhcp4.OptionParameterRequestList, dhcp4RequestParams)
+	addDHCP4Options(&request, identity)
+	request.PadToMinSize()
+	if err = client.SendPacket(request); err != nil {
+		return false, request, err
+	}
+
+	ack, err := client.GetAcknowledgement(&request)
+	if err != nil {
+		return false, ack, err
+	}
+
+	opts := ack.ParseOptions()
+	if dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]) != dhcp4.ACK {
+		return false, ack, nil
+	}
+	return true, ack, nil
+}
+
+func ipList(b []byte) []net.IP {
+	var ips []net.IP
+	for i := 0; i+net.IPv4len <= len(b); i += net.IPv4len {
+		ips = append(ips, net.IPv4(b[i], b[i+1], b[i+2], b[i+3]))
+	}
+	return ips
+}
+
+// parseClasslessRoutes decodes dhcp option 121 (RFC 3442).
+func parseClasslessRoutes(b []byte) ([]dhcp4Route, error) {
+	var routes []dhcp4Route
+	for len(b) > 0 {
+		width := int(b[0])
+		if width > 32 {
+			return nil, fmt.Errorf("invalid classless route width %d", width)
+		}
+		octets := (width + 7) / 8
+		if len(b) < 1+octets+net.IPv4len {
+			return nil, fmt.Errorf("truncated classless route")
+		}
+		dst := make(net.IP, net.IPv4len)
+		copy(dst, b[1:1+octets])
+		gw := b[1+octets : 1+octets+net.IPv4len]
+		routes = append(routes, dhcp4Route{
+			Dst: net.IPNet{IP: dst, Mask: net.CIDRMask(width, 32)},
+			Gw:  net.IPv4(gw[0], gw[1], gw[2], gw[3]),
+		})
+		b = b[1+octets+net.IPv4len:]
+	}
+	return routes, nil
+}
+
+func parseDHCP4Lease(packet dhcp4.Packet) (*dhcp4Lease, error) {
+	opts := packet.ParseOptions()
+
+	ip := packet.YIAddr().To4()
+	if ip == nil || ip.Equal(net.IPv4zero) {
+		return nil, fmt.Errorf("dhcp ack without address")
+	}
+	lease := &dhcp4Lease{IP: net.IPNet{IP: ip, Mask: ip.DefaultMask()}}
+	if m := opts[dhcp4.OptionSubnetMask]; len(m) == net.IPv4len {
+		lease.IP.Mask = net.IPMask(m)
+	}
+
+	lease.Routers = ipList(opts[dhcp4.OptionRouter])
+	lease.DNS = ipList(opts[dhcp4.OptionDomainNameServer])
+	lease.NTP = ipList(opts[dhcp4.OptionNetworkTimeProtocolServers])
+
+	if b, ok := opts[dhcp4.OptionClasslessRouteFormat]; ok {
+		routes, err := parseClasslessRoutes(b)
+		if err != nil {
+			fmt.Printf("dhcp option 121: %s\n", err)
+		}
+		lease.Routes = routes
+	}
+
+	if b, ok := opts[dhcp4OptionDomainSearch]; ok {
+		lease.Search = parseDomainNames(b)
+	} else if b, ok := opts[dhcp4.OptionDomainName]; ok {
+		if domain := strings.TrimRight(string(b), "\x00."); domain != "" {
+			lease.Search = []string{domain}
+		}
+	}
+
+	if b := opts[dhcp4.OptionInterfaceMTU]; len(b) == 2 {
+		lease.MTU = int(binary.BigEndian.Uint16(b))
+	}
+	return lease, nil
+}
+
+// applyDHCP4Lease configures address, mtu, routes and resolvers of a lease
+// on link.
+func applyDHCP4Lease(link netlink.Link, lease *dhcp4Lease) error {
+	index := link.Attrs().Index
+
+	if lease.MTU >= 68 && lease.MTU != link.Attrs().MTU {
+		if debug {
+			fmt.Printf("set mtu %d\n", lease.MTU)
+		}
+		if err := netlink.LinkSetMTU(link, lease.MTU); err != nil {
+			fmt.Printf("set mtu %d err: %s\n", lease.MTU, err)
+		}
+	}
+
+	if debug {
+		fmt.Printf("set addr %s\n", lease.IP.String())
+	}
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: &lease.IP}); err != nil && err != syscall.EEXIST {
+		return err
+	}
+
+	routes := lease.Routes
+	// RFC 3442: the router option is ignored when classless routes are present
+	if len(routes) == 0 && len(lease.Routers) > 0 {
+		routes = []dhcp4Route{{Dst: net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, Gw: lease.Routers[0]}}
+	}
+	for _, route := range routes {
+		r := &netlink.Route{LinkIndex: index, Dst: &net.IPNet{IP: route.Dst.IP, Mask: route.Dst.Mask}}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			r.Dst = &net.IPNet{}
+		}
+		if route.Gw.Equal(net.IPv4zero) {
+			r.Scope = netlink.SCOPE_LINK
+		} else {
+			r.Gw = route.Gw
+		}
+		if r.Dst.IP == nil && r.Gw == nil {
+			continue
+		}
+		if debug {
+			fmt.Printf("add route %s\n", r)
+		}
+		if err := netlink.RouteAdd(r); err != nil && err != syscall.EEXIST {
+			fmt.Printf("route add %s err: %s\n", r, err)
+		}
+	}
+
+	ntpServers = lease.NTP
+	if debug && len(ntpServers) > 0 {
+		fmt.Printf("ntp servers %s\n", ntpServers)
+	}
+
+	var nameservers []net.IP
+	for _, value := range cmdlineVars("nameserver") {
+		if ns := net.ParseIP(strings.Trim(value, "[]")); ns != nil {
+			nameservers = append(nameservers, ns)
+		}
+	}
+	nameservers = append(nameservers, lease.DNS...)
+	if len(nameservers) == 0 {
+		nameservers = fallbackNameservers()
+		if len(nameservers) == 0 {
+			fmt.Printf("no nameservers from dhcp\n")
+			return nil
+		}
+		fmt.Printf("no nameservers from dhcp, using fallback %s\n", nameservers)
+	}
+	return writeResolvConf(nameservers, lease.Search)
+}
+
+// fallbackNameservers returns the resolvers of fallback-dns=<ip>[,<ip>...],
+// the public ones for a bare fallback-dns and none without it.
+func fallbackNameservers() []net.IP {
+	ok, value := cmdlineVar("fallback-dns")
+	if !ok {
+		return nil
+	}
+	if value == "fallback-dns" {
+		return publicNameservers
+	}
+	var nameservers []net.IP
+	for _, s := range strings.Split(value, ",") {
+		if ns := net.ParseIP(strings.Trim(s, "[]")); ns != nil {
+			nameservers = append(nameservers, ns)
+		} else {
+			fmt.Printf("invalid fallback-dns %s\n", s)
+		}
+	}
+	return nameservers
+}
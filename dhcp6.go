@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	dhcp6ClientPort = 546
+	dhcp6ServerPort = 547
+
+	dhcp6Solicit   = 1
+	dhcp6Advertise = 2
+	dhcp6Request   = 3
+	dhcp6Reply     = 7
+
+	dhcp6OptClientID    = 1
+	dhcp6OptServerID    = 2
+	dhcp6OptIANA        = 3
+	dhcp6OptIAAddr      = 5
+	dhcp6OptORO         = 6
+	dhcp6OptElapsedTime = 8
+	dhcp6OptStatusCode  = 13
+	dhcp6OptDNSServers  = 23
+	dhcp6OptDomainList  = 24
+
+	dhcp6StatusSuccess = 0
+
+	dhcp6MaxAttempts = 4
+	dhcp6InitTimeout = time.Second
+)
+
+var allDHCPServers = net.ParseIP("ff02::1:2")
+
+type dhcp6Addr struct {
+	IP        net.IP
+	Preferred uint32
+	Valid     uint32
+}
+
+type dhcp6Lease struct {
+	ServerID []byte
+	IAID     uint32
+	T1       uint32
+	T2       uint32
+	Addrs    []dhcp6Addr
+	DNS      []net.IP
+	Search   []string
+}
+
+type dhcp6Option struct {
+	Code uint16
+	Data []byte
+}
+
+func dhcp6Options(b []byte) ([]dhcp6Option, error) {
+	var opts []dhcp6Option
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated dhcpv6 option")
+		}
+		code := binary.BigEndian.Uint16(b[0:2])
+		olen := int(binary.BigEndian.Uint16(b[2:4]))
+		if 4+olen > len(b) {
+			return nil, fmt.Errorf("truncated dhcpv6 option %d", code)
+		}
+		opts = append(opts, dhcp6Option{Code: code, Data: b[4 : 4+olen]})
+		b = b[4+olen:]
+	}
+	return opts, nil
+}
+
+func dhcp6AppendOption(b []byte, code uint16, data []byte) []byte {
+	var hdr [4]byte
+	binary.BigEndian.PutUint16(hdr[0:2], code)
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(data)))
+	b = append(b, hdr[:]...)
+	return append(b, data...)
+}
+
+// dhcp6DUID returns a DUID-LL (RFC 8415 11.4) for an ethernet address.
+func dhcp6DUID(mac net.HardwareAddr) []byte {
+	duid := []byte{0, 3, 0, 1}
+	return append(duid, mac...)
+}
+
+func dhcp6Status(b []byte) (uint16, string) {
+	if len(b) < 2 {
+		return dhcp6StatusSuccess, ""
+	}
+	return binary.BigEndian.Uint16(b[0:2]), string(b[2:])
+}
+
+// parseDHCP6 decodes an advertise or reply message for transaction xid,
+// client duid and the ia_na iaid. IA_NA options of other iaids are ignored.
+func parseDHCP6(b []byte, xid []byte, duid []byte, iaid uint32) (uint8, *dhcp6Lease, error) {
+	if len(b) < 4 || !bytes.Equal(b[1:4], xid) {
+		return 0, nil, fmt.Errorf("transaction id mismatch")
+	}
+	opts, err := dhcp6Options(b[4:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	lease := &dhcp6Lease{}
+	matched, ia := false, false
+	for _, opt := range opts {
+		switch opt.Code {
+		case dhcp6OptClientID:
+			matched = bytes.Equal(opt.Data, duid)
+		case dhcp6OptServerID:
+			lease.ServerID = opt.Data
+		case dhcp6OptStatusCode:
+			if code, msg := dhcp6Status(opt.Data); code != dhcp6StatusSuccess {
+				return b[0], nil, fmt.Errorf("dhcpv6 status %d: %s", code, msg)
+			}
+		case dhcp6OptIANA:
+			if len(opt.Data) >= 4 && binary.BigEndian.Uint32(opt.Data[0:4]) != iaid {
+				continue
+			}
+			if err = lease.parseIANA(opt.Data); err != nil {
+				return b[0], nil, err
+			}
+			ia = true
+		case dhcp6OptDNSServers:
+			for i := 0; i+net.IPv6len <= len(opt.Data); i += net.IPv6len {
+				ns := make(net.IP, net.IPv6len)
+				copy(ns, opt.Data[i:i+net.IPv6len])
+				lease.DNS = append(lease.DNS, ns)
+			}
+		case dhcp6OptDomainList:
+			lease.Search = append(lease.Search, parseDomainNames(opt.Data)...)
+		}
+	}
+	if !matched {
+		return b[0], nil, fmt.Errorf("client id mismatch")
+	}
+	if lease.ServerID == nil {
+		return b[0], nil, fmt.Errorf("missing server id")
+	}
+	if !ia {
+		return b[0], nil, fmt.Errorf("no ia_na for iaid %d", iaid)
+	}
+	return b[0], lease, nil
+}
+
+func (l *dhcp6Lease) parseIANA(b []byte) error {
+	if len(b) < 12 {
+		return fmt.Errorf("truncated ia_na option")
+	}
+	l.IAID = binary.BigEndian.Uint32(b[0:4])
+	l.T1 = binary.BigEndian.Uint32(b[4:8])
+	l.T2 = binary.BigEndian.Uint32(b[8:12])
+
+	opts, err := dhcp6Options(b[12:])
+	if err != nil {
+		return err
+	}
+	for _, opt := range opts {
+		switch opt.Code {
+		case dhcp6OptStatusCode:
+			if code, msg := dhcp6Status(opt.Data); code != dhcp6StatusSuccess {
+				return fmt.Errorf("ia_na status %d: %s", code, msg)
+			}
+		case dhcp6OptIAAddr:
+			if len(opt.Data) < 24 {
+				continue
+			}
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, opt.Data[0:16])
+			a := dhcp6Addr{
+				IP:        ip,
+				Preferred: binary.BigEndian.Uint32(opt.Data[16:20]),
+				Valid:     binary.BigEndian.Uint32(opt.Data[20:24]),
+			}
+			if a.Valid == 0 {
+				continue
+			}
+			l.Addrs = append(l.Addrs, a)
+		}
+	}
+	return nil
+}
+
+func dhcp6IANA(iaid uint32, addrs []dhcp6Addr) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:4], iaid)
+	for _, a := range addrs {
+		data := make([]byte, 24)
+		copy(data[0:16], a.IP.To16())
+		binary.BigEndian.PutUint32(data[16:20], a.Preferred)
+		binary.BigEndian.PutUint32(data[20:24], a.Valid)
+		b = dhcp6AppendOption(b, dhcp6OptIAAddr, data)
+	}
+	return b
+}
+
+type dhcp6Client struct {
+	iface *net.Interface
+	conn  *net.UDPConn
+	duid  []byte
+	iaid  uint32
+	start time.Time
+}
+
+func newDHCP6Client(iface *net.Interface) (*dhcp6Client, error) {
+	if len(iface.HardwareAddr) == 0 {
+		return nil, fmt.Errorf("%s has no hardware address", iface.Name)
+	}
+
+	var laddr net.IP
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err == nil && ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			laddr = ip
+			break
+		}
+	}
+	if laddr == nil {
+		return nil, fmt.Errorf("%s has no link-local address", iface.Name)
+	}
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: laddr, Port: dhcp6ClientPort, Zone: iface.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dhcp6Client{
+		iface: iface,
+		conn:  conn,
+		duid:  dhcp6DUID(iface.HardwareAddr),
+		iaid:  uint32(iface.Index),
+	}, nil
+}
+
+func (c *dhcp6Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *dhcp6Client) message(typ uint8, xid []byte, serverID []byte, addrs []dhcp6Addr) []byte {
+	b := []byte{typ, xid[0], xid[1], xid[2]}
+	b = dhcp6AppendOption(b, dhcp6OptClientID, c.duid)
+	if serverID != nil {
+		b = dhcp6AppendOption(b, dhcp6OptServerID, serverID)
+	}
+
+	elapsed := make([]byte, 2)
+	cs := time.Since(c.start) / (10 * time.Millisecond)
+	if cs > 0xffff {
+		cs = 0xffff
+	}
+	binary.BigEndian.PutUint16(elapsed, uint16(cs))
+	b = dhcp6AppendOption(b, dhcp6OptElapsedTime, elapsed)
+
+	oro := make([]byte, 4)
+	binary.BigEndian.PutUint16(oro[0:2], dhcp6OptDNSServers)
+	binary.BigEndian.PutUint16(oro[2:4], dhcp6OptDomainList)
+	b = dhcp6AppendOption(b, dhcp6OptORO, oro)
+
+	return dhcp6AppendOption(b, dhcp6OptIANA, dhcp6IANA(c.iaid, addrs))
+}
+
+// exchange sends a message and waits for the expected response, retransmitting
+// with exponential backoff (RFC 8415 15).
+func (c *dhcp6Client) exchange(typ uint8, want uint8, serverID []byte, addrs []dhcp6Addr) (*dhcp6Lease, error) {
+	xid := make([]byte, 3)
+	if _, err := rand.Read(xid); err != nil {
+		return nil, err
+	}
+	dst := &net.UDPAddr{IP: allDHCPServers, Port: dhcp6ServerPort, Zone: c.iface.Name}
+	buf := make([]byte, 1500)
+	rt := dhcp6InitTimeout
+
+	for i := 0; i < dhcp6MaxAttempts; i++ {
+		if debug {
+			fmt.Printf("send dhcp6 message %d on %s\n", typ, c.iface.Name)
+		}
+		if _, err := c.conn.WriteToUDP(c.message(typ, xid, serverID, addrs), dst); err != nil {
+			return nil, err
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(rt))
+		for {
+			n, _, err := c.conn.ReadFromUDP(buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			mt, lease, err := parseDHCP6(buf[:n], xid, c.duid, c.iaid)
+			if mt != want {
+				continue
+			}
+			if err != nil {
+				if debug {
+					fmt.Printf("dhcp6 message %d: %s\n", mt, err)
+				}
+				continue
+			}
+			return lease, nil
+		}
+		rt *= 2
+	}
+	return nil, fmt.Errorf("no dhcpv6 response to message %d on %s", typ, c.iface.Name)
+}
+
+// Request performs the four message solicit/advertise/request/reply exchange
+// and returns the committed lease.
+func (c *dhcp6Client) Request() (*dhcp6Lease, error) {
+	c.start = time.Now()
+
+	adv, err := c.exchange(dhcp6Solicit, dhcp6Advertise, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(adv.Addrs) == 0 {
+		return nil, fmt.Errorf("dhcpv6 server offered no addresses")
+	}
+
+	lease, err := c.exchange(dhcp6Request, dhcp6Reply, adv.ServerID, adv.Addrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(lease.Addrs) == 0 {
+		return nil, fmt.Errorf("dhcpv6 reply contains no addresses")
+	}
+	return lease, nil
+}
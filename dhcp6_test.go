@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDHCP6Options(t *testing.T) {
+	b := dhcp6AppendOption(nil, dhcp6OptServerID, []byte{1, 2, 3})
+	b = dhcp6AppendOption(b, dhcp6OptElapsedTime, nil)
+	opts, err := dhcp6Options(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dhcp6Option{{dhcp6OptServerID, []byte{1, 2, 3}}, {dhcp6OptElapsedTime, []byte{}}}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+	for _, b := range [][]byte{{0, 1, 0}, {0, 1, 0, 4, 1, 2}} {
+		if _, err := dhcp6Options(b); err == nil {
+			t.Errorf("dhcp6Options(%x) succeeded", b)
+		}
+	}
+}
+
+func TestDHCP6Status(t *testing.T) {
+	if code, msg := dhcp6Status(nil); code != dhcp6StatusSuccess || msg != "" {
+		t.Errorf("empty status = %d %q", code, msg)
+	}
+	if code, msg := dhcp6Status([]byte("\x00\x02no addrs")); code != 2 || msg != "no addrs" {
+		t.Errorf("status = %d %q", code, msg)
+	}
+}
+
+// dhcp6TestReply builds a reply for xid and duid with the given options.
+func dhcp6TestReply(xid, duid []byte, opts ...dhcp6Option) []byte {
+	b := append([]byte{dhcp6Reply}, xid...)
+	b = dhcp6AppendOption(b, dhcp6OptClientID, duid)
+	for _, opt := range opts {
+		b = dhcp6AppendOption(b, opt.Code, opt.Data)
+	}
+	return b
+}
+
+func TestParseDHCP6(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	duid := dhcp6DUID(mac)
+	if want := []byte{0, 3, 0, 1, 0x52, 0x54, 0, 0x12, 0x34, 0x56}; !reflect.DeepEqual(duid, want) {
+		t.Errorf("duid = %x, want %x", duid, want)
+	}
+	xid := []byte{0xaa, 0xbb, 0xcc}
+
+	iana := dhcp6IANA(7, []dhcp6Addr{
+		{IP: net.ParseIP("2001:db8::100"), Preferred: 3600, Valid: 7200},
+		{IP: net.ParseIP("2001:db8::101")},
+	})
+	binary.BigEndian.PutUint32(iana[4:8], 1800)
+	binary.BigEndian.PutUint32(iana[8:12], 2880)
+	dns := append(net.ParseIP("2001:db8::53"), net.ParseIP("2001:db8::54")...)
+
+	// the ia of another interface is ignored
+	other := dhcp6IANA(8, []dhcp6Addr{{IP: net.ParseIP("2001:db8::200"), Preferred: 3600, Valid: 7200}})
+
+	typ, lease, err := parseDHCP6(dhcp6TestReply(xid, duid,
+		dhcp6Option{dhcp6OptServerID, []byte{0, 1, 2, 3}},
+		dhcp6Option{dhcp6OptIANA, other},
+		dhcp6Option{dhcp6OptIANA, iana},
+		dhcp6Option{dhcp6OptDNSServers, dns},
+		dhcp6Option{dhcp6OptDomainList, []byte("\x07example\x03com\x00")},
+	), xid, duid, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != dhcp6Reply {
+		t.Errorf("type = %d", typ)
+	}
+	if !reflect.DeepEqual(lease.ServerID, []byte{0, 1, 2, 3}) || lease.IAID != 7 || lease.T1 != 1800 || lease.T2 != 2880 {
+		t.Errorf("lease: %+v", lease)
+	}
+	// addresses with a valid lifetime of 0 are dropped
+	if len(lease.Addrs) != 1 || !lease.Addrs[0].IP.Equal(net.ParseIP("2001:db8::100")) || lease.Addrs[0].Preferred != 3600 || lease.Addrs[0].Valid != 7200 {
+		t.Errorf("addrs: %+v", lease.Addrs)
+	}
+	if len(lease.DNS) != 2 || !lease.DNS[1].Equal(net.ParseIP("2001:db8::54")) {
+		t.Errorf("dns: %v", lease.DNS)
+	}
+	if !reflect.DeepEqual(lease.Search, []string{"example.com"}) {
+		t.Errorf("search: %v", lease.Search)
+	}
+}
+
+func TestParseDHCP6Errors(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	duid := dhcp6DUID(mac)
+	xid := []byte{1, 2, 3}
+	serverID := dhcp6Option{dhcp6OptServerID, []byte{9}}
+	ours := dhcp6Option{dhcp6OptIANA, dhcp6IANA(7, []dhcp6Addr{{IP: net.ParseIP("2001:db8::100"), Valid: 7200}})}
+	other := dhcp6Option{dhcp6OptIANA, dhcp6IANA(8, []dhcp6Addr{{IP: net.ParseIP("2001:db8::200"), Valid: 7200}})}
+	noAddrs := dhcp6AppendOption(dhcp6IANA(7, nil), dhcp6OptStatusCode, []byte("\x00\x02none"))
+	short := []byte{0, 0, 0, 7, 0, 0, 0, 0}
+
+	if _, _, err := parseDHCP6(dhcp6TestReply(xid, duid, serverID, ours), xid, duid, 7); err != nil {
+		t.Fatalf("valid reply: %s", err)
+	}
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"xid", dhcp6TestReply([]byte{3, 2, 1}, duid, serverID, ours)},
+		{"duid", dhcp6TestReply(xid, []byte{0, 3, 0, 1, 1}, serverID, ours)},
+		{"server id", dhcp6TestReply(xid, duid, ours)},
+		{"status", dhcp6TestReply(xid, duid, serverID, ours, dhcp6Option{dhcp6OptStatusCode, []byte("\x00\x01fail")})},
+		{"iaid", dhcp6TestReply(xid, duid, serverID, other)},
+		{"no ia_na", dhcp6TestReply(xid, duid, serverID)},
+		{"ia_na status", dhcp6TestReply(xid, duid, serverID, dhcp6Option{dhcp6OptIANA, noAddrs})},
+		{"ia_na length", dhcp6TestReply(xid, duid, serverID, dhcp6Option{dhcp6OptIANA, short})},
+		{"truncated", dhcp6TestReply(xid, duid, serverID, ours)[:10]},
+	} {
+		if _, lease, err := parseDHCP6(tt.b, xid, duid, 7); err == nil {
+			t.Errorf("%s: got lease %+v", tt.name, lease)
+		}
+	}
+}
@@ -3,28 +3,22 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
-	"crypto/tls"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"runtime"
 	"strings"
 	"time"
 
-	"github.com/biogo/hts/bgzf"
 	"github.com/cheggaaa/pb"
 	"github.com/cloudflare/golibs/bytepool"
-	pgzip "github.com/klauspost/pgzip"
 	"github.com/vtolstov/go-ioctl"
 	compress "github.com/vtolstov/packer-post-processor-compress/compress"
 	"gopkg.in/yaml.v2"
@@ -118,7 +112,29 @@ func (w *zeroSkipWriter) Close() error {
 	return nil
 }
 
-func copyImage(img string, dev string, fetchaddrs []string) (err error) {
+// offsetReader counts the bytes read, for image formats that locate their
+// data by offset in the file.
+type offsetReader struct {
+	r   io.Reader
+	off int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+
+// skipTo discards the input up to off.
+func (o *offsetReader) skipTo(off int64) error {
+	if off < o.off {
+		return fmt.Errorf("offset %d already passed at %d", off, o.off)
+	}
+	_, err := io.CopyN(ioutil.Discard, o, off-o.off)
+	return err
+}
+
+func copyImage(img string, dev string, fetchaddrs []string, proxy string) (err error) {
 
 	var gr io.ReadCloser
 	var h hash.Hash
@@ -127,260 +143,202 @@ func copyImage(img string, dev string, fetchaddrs []string) (err error) {
 	var bar *pb.ProgressBar
 	//	var n int64
 
-	httpTransport := &http.Transport{
-		Dial:            (&net.Dialer{DualStack: true}).Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	httpClient := &http.Client{Transport: httpTransport}
+	transport := newHTTPTransport(proxy)
+	transport.MaxIdleConnsPerHost = rangeWorkers
+	httpClient := &http.Client{Transport: transport}
 
-	var host string
-	var port string
 	var src string
+	var lastErr error
 
-	for _, fetchaddr := range fetchaddrs {
+	for i, fetchaddr := range fetchaddrs {
 		src = fmt.Sprintf("%s/%s", fetchaddr, img)
-		u, err := url.Parse(src)
-		if err != nil {
+		if _, err := url.Parse(src); err != nil {
 			if debug {
 				fmt.Printf("url err: %s", err)
 			}
 			continue
 		}
 
-		if !strings.HasPrefix(u.Host, "[") && strings.Index(u.Host, ":") > 0 {
-			host, port, _ = net.SplitHostPort(u.Host)
-		} else {
-			host = u.Host
-		}
-
-		if port == "" {
-			if u.Scheme == "https" {
-				port = "443"
-			} else {
-				port = "80"
-			}
-		}
-
-		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
-			host = host[1 : len(host)-1]
-		}
-		addrs, err := net.LookupIP(host)
+		res, err := fetch(httpClient, "HEAD", src, fetchAttempts)
 		if err != nil {
-			addrs = []net.IP{net.ParseIP(host)}
-			err = nil
-		}
-
-		for _, addr := range addrs {
-			if ipv4 && addr.To4() == nil {
-				continue
-			}
-			if ipv6 && addr.To4() != nil {
-				continue
+			lastErr = err
+			if debug {
+				fmt.Printf("http err: %s\n", err)
 			}
-
-			req, _ := http.NewRequest("HEAD", src, nil)
-			req.Header.Set("Host", host)
-			req.URL = u
-			req.URL.Host = net.JoinHostPort(addr.String(), port)
-			req.Host = host
-			res, err := httpClient.Do(req)
-			if err != nil || res.StatusCode != 200 {
-				if debug {
-					err = fmt.Errorf("failed to fetch image %s", req)
-					fmt.Printf("http err: %s\n", err)
-					time.Sleep(5 * time.Second)
-				}
+			continue
+		}
+		res.Body.Close()
+		for _, ct := range []string{"md5", "sha1", "sha244", "sha256", "sha384", "sha512"} {
+			res, err = fetch(httpClient, "GET", fmt.Sprintf("%s/%s.%ssums", fetchaddr, img, ct), fetchAttempts)
+			if err != nil {
 				continue
 			}
-			for _, ct := range []string{"md5", "sha1", "sha244", "sha256", "sha384", "sha512"} {
-				csumurl := fmt.Sprintf("%s/%s.%ssums", fetchaddr, img, ct)
-				cu, err := url.Parse(csumurl)
+			rd := bufio.NewReader(res.Body)
+		lines:
+			for {
+				line, err := rd.ReadString('\n')
 				if err != nil {
-					if debug {
-						fmt.Printf("url err: %s", err)
-						time.Sleep(5 * time.Second)
-					}
-					continue
+					break lines
 				}
-				req.URL = cu
-				req.Method = "GET"
-				res, err = httpClient.Do(req)
-				if err == nil && res.StatusCode == 200 && res.Body != nil {
-					rd := bufio.NewReader(res.Body)
-				lines:
-					for {
-						line, err := rd.ReadString('\n')
-						if err != nil {
-							break lines
-						}
-						parts := strings.Fields(line)
-						if len(parts) > 1 {
-							if parts[1] == img {
-								checksum = parts[0]
-								break lines
-							}
-						}
+				parts := strings.Fields(line)
+				if len(parts) > 1 {
+					if parts[1] == img {
+						checksum = parts[0]
+						break lines
 					}
-					res.Body.Close()
-					h = getHash(ct)
-				}
-			}
-			metaurl := fmt.Sprintf("%s/%s.metadata", fetchaddr, img)
-			mu, err := url.Parse(metaurl)
-			if err != nil {
-				if debug {
-					fmt.Printf("url err: %s", err)
-					time.Sleep(5 * time.Second)
 				}
 			}
-			meta := make(compress.Metadata, 0)
-			req.Method = "GET"
-			req.URL = mu
-			res, err = httpClient.Do(req)
-			if err == nil && res.StatusCode == 200 && res.Body != nil {
-				metaBody, _ := ioutil.ReadAll(res.Body)
-				res.Body.Close()
-				if err = yaml.Unmarshal(metaBody, &meta); err != nil {
-					fmt.Printf("metadata err %s\n", err.Error())
-				}
-			} else {
-				if debug && err != nil {
-					fmt.Printf("meta: %s\n", err.Error())
-					time.Sleep(20 * time.Second)
-				}
+			res.Body.Close()
+			h = getHash(ct)
+		}
+		meta := make(compress.Metadata, 0)
+		res, err = fetch(httpClient, "GET", fmt.Sprintf("%s/%s.metadata", fetchaddr, img), fetchAttempts)
+		if err == nil {
+			metaBody, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err = yaml.Unmarshal(metaBody, &meta); err != nil {
+				fmt.Printf("metadata err %s\n", err.Error())
 			}
+		} else if debug {
+			fmt.Printf("meta: %s\n", err.Error())
+		}
 
-			if debug {
-				fmt.Printf("meta %+v\n", meta)
-				time.Sleep(5 * time.Second)
-			}
+		if debug {
+			fmt.Printf("meta %+v\n", meta)
+		}
 
-			if len(meta) > 0 {
-				if m, ok := meta[img]; ok {
-					if m.OrigSize != 0 {
-						bar = pb.New64(m.OrigSize)
-						bar.ShowSpeed = true
-						bar.ShowTimeLeft = true
-						bar.ShowPercent = true
-						bar.SetRefreshRate(time.Second)
-						bar.SetWidth(80)
-						bar.SetMaxWidth(80)
-						bar.SetUnits(pb.U_BYTES)
-						bar.Start()
-						defer bar.Finish()
-					}
+		if len(meta) > 0 {
+			if m, ok := meta[img]; ok {
+				if m.OrigSize != 0 {
+					bar = pb.New64(m.OrigSize)
+					bar.ShowSpeed = true
+					bar.ShowTimeLeft = true
+					bar.ShowPercent = true
+					bar.SetRefreshRate(time.Second)
+					bar.SetWidth(80)
+					bar.SetMaxWidth(80)
+					bar.SetUnits(pb.U_BYTES)
+					bar.Start()
+					defer bar.Finish()
 				}
 			}
+		}
 
-			req.Method = "GET"
-			req.URL = u
-			res, err = httpClient.Do(req)
-			if err != nil || res.StatusCode != 200 {
+		comptype := ""
+		if len(meta) > 0 {
+			comptype = meta[img].CompType
+		}
+
+		// bgzf images are read in ranges from this and the following mirrors
+		var rs io.ReadCloser
+		if comptype == compBgzf {
+			var urls []string
+			for _, addr := range fetchaddrs[i:] {
+				urls = append(urls, fmt.Sprintf("%s/%s", addr, img))
+			}
+			if p, err := newParallelReader(httpClient, urls); err == nil {
+				rs = p
+			} else if debug {
+				fmt.Printf("parallel download: %s\n", err)
+			}
+		}
+		if rs == nil {
+			if rs, err = newResumeReader(httpClient, src); err != nil {
+				lastErr = err
 				if debug {
-					err = fmt.Errorf("failed to fetch image %s", req)
 					fmt.Printf("http err: %s\n", err)
-					time.Sleep(10 * time.Second)
 				}
 				continue
 			}
-			/*
-				rf := &ranger.HTTPRanger{URL: u}
-				if err = rf.Initialize(0); err != nil {
-					fmt.Printf("rf err %s\n", err.Error())
-					continue
-				}
-			*/
-			rs := res.Body
-			defer res.Body.Close()
+		}
+		defer rs.Close()
 
-			fw, err := os.OpenFile(dev, os.O_WRONLY, 0600)
-			if err != nil {
-				fmt.Printf("open err: %s\n", err)
-				time.Sleep(10 * time.Second)
+		fw, err := os.OpenFile(dev, os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Printf("open err: %s\n", err)
+			time.Sleep(10 * time.Second)
+			return err
+		}
+		defer fw.Close()
+		zsw := ZeroSkipWriter(fw)
+		defer zsw.Close()
+		//TODO: check for error
+
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		var cmw io.Writer
+		if checksum != "" {
+			cmw = io.MultiWriter(pw, h)
+		} else {
+			cmw = io.MultiWriter(pw)
+		}
+
+		go func() {
+			// a download failing for good fails the decompressor too
+			_, err := io.Copy(cmw, rs)
+			pw.CloseWithError(err)
+		}()
+
+		// the metadata may leave out the comptype, the magic bytes tell
+		br := bufio.NewReader(pr)
+		if comptype == "" {
+			if comptype, err = detectCompression(br); err != nil {
 				return err
 			}
-			defer fw.Close()
-			zsw := ZeroSkipWriter(fw)
-			defer zsw.Close()
-			//TODO: check for error
-
-			comptype := ""
-			if len(meta) > 0 {
-				comptype = meta[img].CompType
-			}
+		}
+		if debug {
+			fmt.Printf("comptype %s\n", comptype)
+		}
 
-			pr, pw := io.Pipe()
-			var cmw io.Writer
-			if checksum != "" {
-				cmw = io.MultiWriter(pw, h)
-			} else {
-				cmw = io.MultiWriter(pw)
-			}
-
-			go func() {
-				//TODO: chck for error
-				_, err := io.Copy(cmw, rs)
-				if err != nil {
-					fmt.Printf("copy err: %s\n", err)
-					time.Sleep(10 * time.Second)
-				}
-				err = pw.Close()
-				if err != nil {
-					fmt.Printf("close err: %s\n", err)
-					time.Sleep(10 * time.Second)
-				}
-			}()
-
-			switch comptype {
-			case "bgzf":
-				gr, err = bgzf.NewReader(pr, runtime.NumCPU())
-			case "pgzip":
-				gr, err = pgzip.NewReader(pr)
-			case "gzip":
-				gr, err = gzip.NewReader(pr)
-			default:
-				if gr, err = pgzip.NewReader(pr); err != nil {
-					if gr, err = bgzf.NewReader(pr, runtime.NumCPU()); err != nil {
-						if gr, err = gzip.NewReader(pr); err != nil {
-							fmt.Printf("gz error: %s\n", err)
-							return err
-						}
-					}
-				}
+		var progress io.Writer
+		if len(meta) > 0 {
+			if m, ok := meta[img]; ok && m.OrigSize != 0 {
+				progress = bar
 			}
+		}
 
-			if err != nil {
+		switch comptype {
+		case compQcow2:
+			err = writeQcow2(br, fw, progress)
+		case compVmdk:
+			err = writeVmdk(br, fw, progress)
+		case compVhd:
+			err = writeVhd(br, fw, progress)
+		default:
+			if gr, err = decompressor(comptype, br); err != nil {
 				return err
 			}
-
 			defer gr.Close()
-			writers := []io.Writer{zsw}
 
-			if len(meta) > 0 {
-				if m, ok := meta[img]; ok && m.OrigSize != 0 {
-					writers = append(writers, bar)
-				}
+			writers := []io.Writer{zsw}
+			if progress != nil {
+				writers = append(writers, progress)
 			}
-
 			mw = io.MultiWriter(writers...)
-			io.Copy(mw, gr)
-
-			if checksum != "" {
-				if checksum != fmt.Sprintf("%x", h.Sum(nil)) {
-					err = fmt.Errorf("checksum mismatch %s != %s", checksum, fmt.Sprintf("%x", h.Sum(nil)))
-					if debug {
-						fmt.Printf("%s\n", err.Error())
-						time.Sleep(10 * time.Second)
-					}
-					return err
-				} else {
-					fmt.Printf("checksum ok %s == %s\n", checksum, fmt.Sprintf("%x", h.Sum(nil)))
+			_, err = io.Copy(mw, gr)
+		}
+		if err != nil {
+			return err
+		}
+
+		if checksum != "" {
+			if checksum != fmt.Sprintf("%x", h.Sum(nil)) {
+				err = fmt.Errorf("checksum mismatch %s != %s", checksum, fmt.Sprintf("%x", h.Sum(nil)))
+				if debug {
+					fmt.Printf("%s\n", err.Error())
+					time.Sleep(10 * time.Second)
 				}
+				return err
+			} else {
+				fmt.Printf("checksum ok %s == %s\n", checksum, fmt.Sprintf("%x", h.Sum(nil)))
 			}
-			return nil
 		}
+		return nil
+	}
+	if lastErr != nil {
+		return lastErr
 	}
-	return fmt.Errorf("failed to fetch image %s", err.Error())
+	return fmt.Errorf("no fetch url for image %s", img)
 }
 
 func blkpart(dst string) error {
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ec2MetadataURL = "http://169.254.169.254"
+	ec2APIVersion  = "latest"
+
+	// defaults of the cloud-init ec2 datasource
+	ec2Timeout = 50 * time.Second
+	ec2MaxWait = 120 * time.Second
+)
+
+// ec2Datasource reads metadata and user-data from an ec2 compatible metadata
+// service, waiting up to MaxWait seconds for one of the MetadataUrls to answer.
+type ec2Datasource struct {
+	urls    []string
+	timeout time.Duration
+	maxWait time.Duration
+	client  *http.Client
+	base    string
+}
+
+func newEc2Datasource(cfg Ec2) *ec2Datasource {
+	e := &ec2Datasource{
+		urls:    cfg.MetadataUrls,
+		timeout: time.Duration(cfg.Timeout) * time.Second,
+		maxWait: time.Duration(cfg.MaxWait) * time.Second,
+	}
+	if len(e.urls) == 0 {
+		e.urls = []string{ec2MetadataURL}
+	}
+	if e.timeout <= 0 {
+		e.timeout = ec2Timeout
+	}
+	if e.maxWait <= 0 {
+		e.maxWait = ec2MaxWait
+	}
+	e.client = newHTTPClient(e.timeout)
+	return e
+}
+
+func (e *ec2Datasource) Type() string {
+	return "ec2"
+}
+
+// wait picks the first metadata url serving an instance-id.
+func (e *ec2Datasource) wait() error {
+	if e.base != "" {
+		return nil
+	}
+	var bases []string
+	for _, u := range e.urls {
+		bases = append(bases, strings.TrimRight(u, "/")+"/"+ec2APIVersion)
+	}
+	base, err := waitForURL(e.client, bases, "/meta-data/instance-id", e.maxWait)
+	if err != nil {
+		return err
+	}
+	e.base = base
+	return nil
+}
+
+// crawl walks the metadata tree below path, entries ending in a slash are
+// directories and key=name entries like public-keys list their index.
+// Entries that fail to fetch are left out, only the index of path itself
+// is required.
+func (e *ec2Datasource) crawl(path string, md map[string]string) error {
+	buf, err := httpGet(e.client, e.base+"/meta-data/"+path)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 {
+			line = line[:i] + "/"
+		}
+		if strings.HasSuffix(line, "/") {
+			if err = e.crawl(path+line, md); err != nil && debug {
+				fmt.Printf("ec2 metadata %s: %s\n", path+line, err)
+			}
+			continue
+		}
+		value, err := httpGet(e.client, e.base+"/meta-data/"+path+line)
+		if err != nil {
+			if debug {
+				fmt.Printf("ec2 metadata %s: %s\n", path+line, err)
+			}
+			continue
+		}
+		md[path+line] = string(value)
+	}
+	return nil
+}
+
+func (e *ec2Datasource) FetchMetadata() (map[string]string, error) {
+	if err := e.wait(); err != nil {
+		return nil, err
+	}
+	md := make(map[string]string)
+	if err := e.crawl("", md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+func (e *ec2Datasource) FetchUserdata() ([]byte, error) {
+	if err := e.wait(); err != nil {
+		return nil, err
+	}
+	buf, err := httpGet(e.client, e.base+"/user-data")
+	if isNotFound(err) {
+		return nil, fmt.Errorf("ec2 instance has no user-data")
+	}
+	return buf, err
+}
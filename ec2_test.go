@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// ec2 metadata tree as served below /latest/meta-data/, directory listings
+// end in a slash and public-keys lists its index as key=name.
+var ec2TestTree = map[string]string{
+	"":                            "instance-id\nlocal-hostname\nplacement/\npublic-keys/\nbroken\nmissing\nmissing-dir/\n",
+	"instance-id":                 "i-0123456789abcdef0",
+	"local-hostname":              "ip-10-0-0-2.ec2.internal",
+	"placement/":                  "availability-zone",
+	"placement/availability-zone": "us-east-1a",
+	"public-keys/":                "0=test-key\n",
+	"public-keys/0/":              "openssh-key",
+	"public-keys/0/openssh-key":   "ssh-rsa AAAAB3NzaC1yc2E test@example",
+}
+
+func newEc2TestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/latest/meta-data/"
+		if len(r.URL.Path) < len(prefix) || r.URL.Path[:len(prefix)] != prefix {
+			http.NotFound(w, r)
+			return
+		}
+		// a leaf the service fails on, the listed missing entries 404
+		if r.URL.Path[len(prefix):] == "broken" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, ok := ec2TestTree[r.URL.Path[len(prefix):]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestEc2FetchMetadata(t *testing.T) {
+	srv := newEc2TestServer()
+	defer srv.Close()
+
+	e := newEc2Datasource(Ec2{MetadataUrls: []string{srv.URL + "/"}, Timeout: 5, MaxWait: 1})
+	md, err := e.FetchMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"instance-id":                 "i-0123456789abcdef0",
+		"local-hostname":              "ip-10-0-0-2.ec2.internal",
+		"placement/availability-zone": "us-east-1a",
+		"public-keys/0/openssh-key":   "ssh-rsa AAAAB3NzaC1yc2E test@example",
+	}
+	// broken, missing and missing-dir/ are left out
+	if len(md) != len(want) {
+		t.Errorf("got %d keys %v, want %d", len(md), md, len(want))
+	}
+	for k, v := range want {
+		if md[k] != v {
+			t.Errorf("%s = %q, want %q", k, md[k], v)
+		}
+	}
+}
+
+func TestEc2NoUserdata(t *testing.T) {
+	srv := newEc2TestServer()
+	defer srv.Close()
+
+	e := newEc2Datasource(Ec2{MetadataUrls: []string{srv.URL}, Timeout: 5, MaxWait: 1})
+	if _, err := e.FetchUserdata(); err == nil || err.Error() != "ec2 instance has no user-data" {
+		t.Errorf("got %v, want no user-data error", err)
+	}
+}
+
+func TestEc2MissingEntry(t *testing.T) {
+	srv := newEc2TestServer()
+	defer srv.Close()
+
+	e := newEc2Datasource(Ec2{MetadataUrls: []string{srv.URL}, Timeout: 5, MaxWait: 1})
+	if err := e.wait(); err != nil {
+		t.Fatal(err)
+	}
+	md := make(map[string]string)
+	if err := e.crawl("network/", md); err == nil {
+		t.Errorf("crawl of a missing directory succeeded with %v", md)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	gosync "sync"
+	"time"
+)
+
+const (
+	// attempts of a request before fetch gives up
+	fetchAttempts = 4
+
+	fetchBackoff    = 500 * time.Millisecond
+	fetchMaxBackoff = 30 * time.Second
+
+	dialTimeout = 10 * time.Second
+
+	// delay before racing the next address of a host, RFC 8305
+	happyEyeballsDelay = 250 * time.Millisecond
+)
+
+// fetchDeadline bounds all requests once the cloud-config sets a
+// bootstrap timeout, zero means no deadline.
+var fetchDeadline time.Time
+
+var jitterSeed gosync.Once
+
+// jitter returns a random duration below d. The source is seeded once with
+// the machine identity, machines booting together would draw the same
+// delays from the clock alone.
+func jitter(d time.Duration) time.Duration {
+	jitterSeed.Do(func() {
+		h := fnv.New64a()
+		for _, v := range machineVars() {
+			h.Write([]byte(v[1]))
+		}
+		rand.Seed(int64(h.Sum64()) ^ time.Now().UnixNano())
+	})
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// fetchError is returned by fetch when no attempt succeeded. StatusCode is
+// the http status of the last response, 0 if there was none.
+type fetchError struct {
+	Method     string
+	URL        string
+	Attempts   int
+	StatusCode int
+	Err        error
+}
+
+func (e *fetchError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s %s: http status %d after %d attempts", e.Method, e.URL, e.StatusCode, e.Attempts)
+	}
+	return fmt.Sprintf("%s %s: %s after %d attempts", e.Method, e.URL, e.Err, e.Attempts)
+}
+
+// Temporary is true for errors worth retrying later, network errors and
+// server side http errors.
+func (e *fetchError) Temporary() bool {
+	return e.StatusCode == 0 || e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*fetchError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// fetch sends a request without body to rawurl, see fetchDo.
+func fetch(client *http.Client, method, rawurl string, attempts int) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawurl, nil)
+	if err != nil {
+		return nil, &fetchError{Method: method, URL: rawurl, Err: err}
+	}
+	return fetchDo(client, req, attempts)
+}
+
+// fetchDo sends req up to attempts times until the server answers with a
+// 2xx status, backing off exponentially with jitter between attempts.
+// Client errors other than 429 are not retried. The caller closes the body
+// of the returned response.
+func fetchDo(client *http.Client, req *http.Request, attempts int) (*http.Response, error) {
+	authorize(req)
+	ferr := &fetchError{Method: req.Method, URL: req.URL.String()}
+	backoff := fetchBackoff
+
+	for ferr.Attempts < attempts {
+		c := *client
+		if !fetchDeadline.IsZero() {
+			left := fetchDeadline.Sub(time.Now())
+			if left <= 0 {
+				if ferr.Err == nil {
+					ferr.Err = fmt.Errorf("install deadline exceeded")
+				}
+				return nil, ferr
+			}
+			if c.Timeout == 0 || left < c.Timeout {
+				c.Timeout = left
+			}
+		}
+
+		ferr.Attempts++
+		res, err := c.Do(req)
+		if err == nil && res.StatusCode >= 200 && res.StatusCode < 300 {
+			return res, nil
+		}
+		if err != nil {
+			ferr.StatusCode = 0
+			ferr.Err = err
+		} else {
+			res.Body.Close()
+			ferr.StatusCode = res.StatusCode
+			ferr.Err = fmt.Errorf("http status %d", res.StatusCode)
+		}
+		if debug {
+			fmt.Printf("%s %s attempt %d: %s\n", req.Method, req.URL, ferr.Attempts, ferr.Err)
+		}
+		if !ferr.Temporary() || ferr.Attempts >= attempts {
+			break
+		}
+
+		// equal jitter, a random delay in the upper half of the backoff
+		delay := backoff/2 + jitter(backoff/2)
+		if !fetchDeadline.IsZero() && time.Now().Add(delay).After(fetchDeadline) {
+			break
+		}
+		time.Sleep(delay)
+		if backoff *= 2; backoff > fetchMaxBackoff {
+			backoff = fetchMaxBackoff
+		}
+	}
+	return nil, ferr
+}
+
+// lookupIP resolves host, giving up at fetchDeadline. The lookup itself
+// can not be canceled and finishes in the background.
+func lookupIP(host string) ([]net.IP, error) {
+	if fetchDeadline.IsZero() {
+		return net.LookupIP(host)
+	}
+	left := fetchDeadline.Sub(time.Now())
+	if left <= 0 {
+		return nil, fmt.Errorf("lookup %s: install deadline exceeded", host)
+	}
+
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		ips, err := net.LookupIP(host)
+		results <- result{ips, err}
+	}()
+	timer := time.NewTimer(left)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.ips, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("lookup %s: install deadline exceeded", host)
+	}
+}
+
+// dialHost races connections to the addresses of the host in addr that
+// match the configured address family, ipv6 first, starting the next
+// attempt after happyEyeballsDelay or as soon as one fails.
+func dialHost(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6, ips []net.IP
+	for _, ip := range addrs {
+		switch {
+		case ip.To4() != nil && !ipv6:
+			v4 = append(v4, ip)
+		case ip.To4() == nil && !ipv4:
+			v6 = append(v6, ip)
+		}
+	}
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ips = append(ips, v6[i])
+		}
+		if i < len(v4) {
+			ips = append(ips, v4[i])
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no usable address for %s", host)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	dialer := &net.Dialer{Timeout: dialTimeout, Deadline: fetchDeadline}
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections of the losers
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if debug {
+				fmt.Printf("dial %s\n", r.err)
+			}
+			lastErr = r.err
+			if next < len(ips) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		if d < 0 || d >= time.Second {
+			t.Fatalf("jitter(1s) = %s", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 90 {
+		t.Errorf("%d different delays of 100", len(seen))
+	}
+	if d := jitter(0); d != 0 {
+		t.Errorf("jitter(0) = %s", d)
+	}
+}
+
+func TestDialHostDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	defer func() { fetchDeadline = time.Time{} }()
+	fetchDeadline = time.Now().Add(time.Minute)
+	conn, err := dialHost("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	fetchDeadline = time.Now().Add(-time.Second)
+	if _, err := dialHost("tcp", l.Addr().String()); err == nil || !strings.Contains(err.Error(), "deadline") {
+		t.Errorf("dial after the deadline: %v", err)
+	}
+}
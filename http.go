@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -13,164 +12,131 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-func getDataSource() (dataSource DataSource, err error) {
-	httpTransport := &http.Transport{
-		Dial:            (&net.Dialer{DualStack: true}).Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: newHTTPTransport(installerProxy()), Timeout: timeout}
+}
+
+// httpGet fetches rawurl with retries.
+func httpGet(httpClient *http.Client, rawurl string) ([]byte, error) {
+	res, err := fetch(httpClient, "GET", rawurl, fetchAttempts)
+	if err != nil {
+		return nil, err
 	}
-	httpClient := &http.Client{Transport: httpTransport, Timeout: 10 * time.Second}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
 
-	var res *http.Response
-	var urlDataSource string
-	var buffer []byte
-	var ok bool
+// machineVars identify the machine towards the metadata server.
+func machineVars() [][2]string {
+	var mac string
+	if iface, err := net.InterfaceByName(netIface); err == nil {
+		mac = iface.HardwareAddr.String()
+	}
+	return [][2]string{
+		{"mac", mac},
+		{"uuid", productUUID()},
+		{"serial", productSerial()},
+		{"arch", machineArch()},
+	}
+}
 
-	ok, urlDataSource = cmdlineVar("cloud-config-url")
+// cloudConfigURL returns the cloud-config-url parameter identifying the
+// machine. Placeholders like {mac}, {uuid}, {serial} and {arch} are
+// replaced, escaped for the part of the url they are in, without any the
+// known values are added as query parameters.
+func cloudConfigURL() (bool, string) {
+	ok, rawurl := cmdlineVar("cloud-config-url")
 	if !ok {
-		return dataSource, fmt.Errorf("no datasource available")
+		return false, ""
 	}
-	var host string
-	var port string
-	u, _ := url.Parse(urlDataSource)
-	if strings.Index(u.Host, ":") > 0 {
-		host, port, _ = net.SplitHostPort(u.Host)
-	} else {
-		host = u.Host
+
+	vars := machineVars()
+	path, query := rawurl, ""
+	if i := strings.IndexAny(rawurl, "?#"); i >= 0 {
+		path, query = rawurl[:i], rawurl[i:]
 	}
-	if port == "" {
-		if u.Scheme == "https" {
-			port = "443"
-		} else {
-			port = "80"
+	templated := false
+	for _, v := range vars {
+		p := "{" + v[0] + "}"
+		if strings.Contains(path, p) || strings.Contains(query, p) {
+			path = strings.Replace(path, p, pathEscape(v[1]), -1)
+			query = strings.Replace(query, p, url.QueryEscape(v[1]), -1)
+			templated = true
 		}
 	}
-	addrs, err := net.LookupIP(host)
-	if err != nil {
-		return dataSource, err
+	if templated {
+		return true, path + query
 	}
 
-	for _, addr := range addrs {
-		if ipv4 && addr.To4() == nil {
-			continue
-		}
-		if ipv6 && addr.To4() != nil {
-			continue
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return true, rawurl
+	}
+	values := u.Query()
+	for _, v := range vars {
+		if v[1] != "" {
+			values.Set(v[0], v[1])
 		}
+	}
+	u.RawQuery = values.Encode()
+	return true, u.String()
+}
 
-		req, _ := http.NewRequest("GET", urlDataSource, nil)
-		req.URL = u
-		req.URL.Host = net.JoinHostPort(addr.String(), port)
-		req.Host = host
-
-		res, err = httpClient.Do(req)
-		if err != nil || res.StatusCode != 200 {
-			if debug {
-				fmt.Printf("http: %s", err)
-				time.Sleep(10 * time.Second)
-			}
-			continue
-		}
-		defer res.Body.Close()
+// pathEscape escapes s as a single path segment, url.PathEscape is go1.8.
+func pathEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
 
-		buffer, err = ioutil.ReadAll(res.Body)
-		if err != nil {
-			continue
-		}
-		err = yaml.Unmarshal(buffer, &dataSource)
-		if err != nil {
-			if debug {
-				fmt.Printf("http: %s", err)
-				time.Sleep(10 * time.Second)
-			}
-			continue
-		}
-		return dataSource, nil
+func getDataSource() (dataSource DataSource, err error) {
+	ok, urlDataSource := cloudConfigURL()
+	if !ok {
+		return dataSource, fmt.Errorf("no datasource available")
 	}
 
-	return
+	buffer, err := httpGet(newHTTPClient(10*time.Second), urlDataSource)
+	if err != nil {
+		return dataSource, err
+	}
+	err = yaml.Unmarshal(buffer, &dataSource)
+	dataSource.userdata = buffer
+	return dataSource, err
 }
 
 func getCloudConfig(dataSource DataSource) (cloudConfig CloudConfig, err error) {
-	httpTransport := &http.Transport{
-		Dial:            (&net.Dialer{DualStack: true}).Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	sources := datasources(dataSource)
+	if len(sources) == 0 {
+		return cloudConfig, fmt.Errorf("no datasource available")
 	}
-	var metadataUrl string
-	var metadataUrls []string
-	httpClient := &http.Client{Transport: httpTransport, Timeout: 10 * time.Second}
-	var res *http.Response
-	var buffer []byte
-	var ok bool
 
-	if dataSource.Datasource.Ec2.MetadataUrls == nil {
-		ok, metadataUrl = cmdlineVar("cloud-config-url")
-		if !ok {
-			return cloudConfig, fmt.Errorf("no datasource available")
+	var errs []string
+	for _, ds := range sources {
+		if debug {
+			fmt.Printf("try datasource %s\n", ds.Type())
 		}
-		metadataUrls = append(metadataUrls, metadataUrl)
-	} else {
-		metadataUrls = dataSource.Datasource.Ec2.MetadataUrls
-	}
-
-	for _, metadataUrl := range metadataUrls {
-		var host string
-		var port string
-		u, _ := url.Parse(metadataUrl)
-		if strings.Index(u.Host, ":") > 0 {
-			host, port, _ = net.SplitHostPort(u.Host)
-		} else {
-			host = u.Host
-		}
-		if port == "" {
-			if u.Scheme == "https" {
-				port = "443"
-			} else {
-				port = "80"
+		md, err := ds.FetchMetadata()
+		if err != nil {
+			if debug {
+				fmt.Printf("datasource %s metadata: %s\n", ds.Type(), err)
 			}
+			errs = append(errs, fmt.Sprintf("%s metadata: %s", ds.Type(), err))
+			continue
 		}
-
-		addrs, err := net.LookupIP(host)
+		buffer, err := ds.FetchUserdata()
 		if err != nil {
-			return cloudConfig, err
-		}
-
-		for _, addr := range addrs {
-			if ipv4 && addr.To4() == nil {
-				continue
-			}
-			if ipv6 && addr.To4() != nil {
-				continue
-			}
-
-			req, _ := http.NewRequest("GET", metadataUrl, nil)
-			req.URL = u
-			req.URL.Host = net.JoinHostPort(addr.String(), port)
-			req.Host = host
-
-			res, err = httpClient.Do(req)
-			if err != nil || res.StatusCode != 200 {
-				if debug {
-					fmt.Printf("http %s", err)
-					time.Sleep(10 * time.Second)
-				}
-				continue
-			}
-			defer res.Body.Close()
-
-			buffer, err = ioutil.ReadAll(res.Body)
-			if err != nil {
-				continue
-			}
-			err = yaml.Unmarshal(buffer, &cloudConfig)
-			if err != nil {
-				if debug {
-					fmt.Printf("http %s", err)
-					time.Sleep(10 * time.Second)
-				}
-				continue
+			if debug {
+				fmt.Printf("datasource %s userdata: %s\n", ds.Type(), err)
 			}
+			errs = append(errs, fmt.Sprintf("%s userdata: %s", ds.Type(), err))
+			continue
+		}
+		// the user-data is meant for this host, report why it is unusable
+		// instead of trying the next datasource
+		if cloudConfig, err = parseUserdata(buffer); err != nil {
+			return cloudConfig, fmt.Errorf("datasource %s cloud-config: %s", ds.Type(), err)
 		}
+		metadata = md
+		applyMetadata(md, &cloudConfig)
 		return cloudConfig, nil
 	}
-	return cloudConfig, fmt.Errorf("failed to get cloud-config")
+	return cloudConfig, fmt.Errorf("failed to get cloud-config: %s", strings.Join(errs, "; "))
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPathEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"52:54:00:12:34:56": "52%3A54%3A00%3A12%3A34%3A56",
+		"VMware serial 1/2": "VMware%20serial%201%2F2",
+		"x86_64":            "x86_64",
+	} {
+		if got := pathEscape(in); got != want {
+			t.Errorf("pathEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestHTTPLogURL checks the log parameters are added as a query to a
+// cloud-config-url templated in its path.
+func TestHTTPLogURL(t *testing.T) {
+	var got *url.URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL
+	}))
+	defer srv.Close()
+
+	saved := cmdline
+	defer func() { cmdline = saved }()
+
+	for _, tt := range []struct {
+		param, path string
+		query       url.Values
+	}{
+		{srv.URL + "/cfg/{arch}", "/cfg/" + machineArch(), url.Values{}},
+		{srv.URL + "/cfg?arch={arch}&site=a", "/cfg", url.Values{"arch": {machineArch()}, "site": {"a"}}},
+	} {
+		cmdline = []string{"cloud-config-url=" + tt.param}
+		got = nil
+		if err := logError("disk /dev/sda not found & retried"); err != nil {
+			t.Errorf("%s: %s", tt.param, err)
+			continue
+		}
+		if got.Path != tt.path {
+			t.Errorf("%s: path %q, want %q", tt.param, got.Path, tt.path)
+		}
+		q := got.Query()
+		tt.query.Set("action", "log")
+		tt.query.Set("flag", "install_error")
+		tt.query.Set("message", "disk /dev/sda not found & retried")
+		tt.query.Set("tls", "ca")
+		for k := range tt.query {
+			if q.Get(k) != tt.query.Get(k) {
+				t.Errorf("%s: %s = %q, want %q", tt.param, k, q.Get(k), tt.query.Get(k))
+			}
+		}
+	}
+}
@@ -14,7 +14,9 @@ var (
 	debug   = false
 )
 
-func init() {
+// initSystem mounts the kernel filesystems and reads the kernel command
+// line, run by main in init mode only.
+func initSystem() {
 	var err error
 
 	if _, err := os.Stat("/proc"); err != nil {
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const isoSectorSize = 2048
+
+// isoFS is a read only ISO9660 reader preferring Joliet names and falling
+// back to Rock Ridge or plain 8.3 names.
+type isoFS struct {
+	r      io.ReaderAt
+	label  string
+	root   isoRecord
+	joliet bool
+}
+
+type isoRecord struct {
+	name   string
+	extent uint32
+	size   uint32
+	dir    bool
+}
+
+func openISO9660(r io.ReaderAt) (*isoFS, error) {
+	iso := &isoFS{r: r}
+	buf := make([]byte, isoSectorSize)
+	primary := false
+
+	for sector := int64(16); sector < 64; sector++ {
+		if _, err := r.ReadAt(buf, sector*isoSectorSize); err != nil {
+			return nil, err
+		}
+		if string(buf[1:6]) != "CD001" {
+			return nil, fmt.Errorf("no iso9660 volume descriptor")
+		}
+		switch buf[0] {
+		case 1:
+			iso.label = strings.TrimSpace(string(buf[40:72]))
+			if !iso.joliet {
+				iso.root, _ = parseISORecord(buf[156:190], false)
+			}
+			primary = true
+		case 2:
+			esc := string(buf[88:91])
+			if esc == "%/@" || esc == "%/C" || esc == "%/E" {
+				iso.root, _ = parseISORecord(buf[156:190], true)
+				iso.joliet = true
+			}
+		case 255:
+			if !primary {
+				return nil, fmt.Errorf("no iso9660 primary volume descriptor")
+			}
+			return iso, nil
+		}
+	}
+	return nil, fmt.Errorf("unterminated iso9660 volume descriptors")
+}
+
+func parseISORecord(b []byte, joliet bool) (isoRecord, int) {
+	n := int(b[0])
+	if n < 34 || n > len(b) {
+		return isoRecord{}, n
+	}
+	rec := isoRecord{
+		extent: binary.LittleEndian.Uint32(b[2:6]),
+		size:   binary.LittleEndian.Uint32(b[10:14]),
+		dir:    b[25]&0x02 != 0,
+	}
+
+	nlen := int(b[32])
+	if 33+nlen > n {
+		return isoRecord{}, n
+	}
+	raw := b[33 : 33+nlen]
+	switch {
+	case nlen == 1 && raw[0] == 0:
+		rec.name = "."
+	case nlen == 1 && raw[0] == 1:
+		rec.name = ".."
+	case joliet:
+		u := make([]uint16, nlen/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(raw[2*i:])
+		}
+		rec.name = string(utf16.Decode(u))
+	default:
+		// the system use area follows the name padded to an even offset
+		if su := 33 + nlen + (1 - nlen%2); su < n {
+			rec.name = rockRidgeName(b[su:n])
+		}
+		if rec.name == "" {
+			rec.name = strings.ToLower(strings.TrimSuffix(strings.SplitN(string(raw), ";", 2)[0], "."))
+		}
+	}
+	if i := strings.Index(rec.name, ";"); joliet && i >= 0 {
+		rec.name = rec.name[:i]
+	}
+	return rec, n
+}
+
+// rockRidgeName returns the alternate name from the NM entries of a system
+// use area.
+func rockRidgeName(b []byte) string {
+	var name string
+	for len(b) >= 4 {
+		n := int(b[2])
+		if n < 4 || n > len(b) {
+			break
+		}
+		if string(b[0:2]) == "NM" && n >= 5 {
+			name += string(b[5:n])
+		}
+		b = b[n:]
+	}
+	return name
+}
+
+func (iso *isoFS) readDir(dir isoRecord) ([]isoRecord, error) {
+	buf := make([]byte, dir.size)
+	if _, err := iso.r.ReadAt(buf, int64(dir.extent)*isoSectorSize); err != nil {
+		return nil, err
+	}
+
+	var records []isoRecord
+	for i := 0; i < len(buf); {
+		if buf[i] == 0 {
+			// records never cross sectors, the rest is padding
+			i = (i/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		rec, n := parseISORecord(buf[i:], iso.joliet)
+		if n == 0 {
+			break
+		}
+		if rec.name != "" && rec.name != "." && rec.name != ".." {
+			records = append(records, rec)
+		}
+		i += n
+	}
+	return records, nil
+}
+
+// ReadFile returns the content of the file at the slash separated path.
+func (iso *isoFS) ReadFile(path string) ([]byte, error) {
+	rec := iso.root
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if !rec.dir {
+			return nil, fmt.Errorf("%s: not a directory", path)
+		}
+		records, err := iso.readDir(rec)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, r := range records {
+			if r.name == part {
+				rec = r
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: file not found", path)
+		}
+	}
+	if rec.dir {
+		return nil, fmt.Errorf("%s: is a directory", path)
+	}
+
+	buf := make([]byte, rec.size)
+	if _, err := iso.r.ReadAt(buf, int64(rec.extent)*isoSectorSize); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	gosync "sync"
+	"syscall"
+	"time"
+
+	"github.com/d2g/dhcp4"
+	"github.com/d2g/dhcp4client"
+	"github.com/vishvananda/netlink"
+)
+
+// dhcp4MinRetry is the shortest interval between renew attempts (RFC 2131 4.4.5).
+const dhcp4MinRetry = 60 * time.Second
+
+// leaseManager holds the lease of the interface selected by networkAuto4.
+// It is guarded by leaseMu as reboot may run from the bootstrap timeout,
+// no new manager starts once the leases were released.
+var (
+	leaseMu       gosync.Mutex
+	leaseManager  *dhcp4Manager
+	leaseReleased bool
+)
+
+// dhcp4Manager keeps a dhcp4 lease alive while the installer runs: it renews
+// with the leasing server at T1, rebinds with any server at T2 and starts over
+// with discover once the lease expired or was refused.
+type dhcp4Manager struct {
+	ifname string
+	link   netlink.Link
+	ack    dhcp4.Packet
+	lease  *dhcp4Lease
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func startLeaseManager(res *dhcp4Result) {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	stopLeaseManagerLocked()
+	if leaseReleased {
+		return
+	}
+
+	leaseManager = &dhcp4Manager{
+		ifname: res.ifname,
+		link:   res.link,
+		ack:    res.ack,
+		lease:  res.lease,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go leaseManager.run(time.Now())
+}
+
+func stopLeaseManager() *dhcp4Manager {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	return stopLeaseManagerLocked()
+}
+
+func stopLeaseManagerLocked() *dhcp4Manager {
+	m := leaseManager
+	if m == nil {
+		return nil
+	}
+	leaseManager = nil
+	close(m.stop)
+	<-m.done
+	return m
+}
+
+// releaseLeases gives the current dhcp4 lease back to the server, once.
+func releaseLeases() {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	if leaseReleased {
+		return
+	}
+	leaseReleased = true
+	m := stopLeaseManagerLocked()
+	if m == nil {
+		return
+	}
+
+	if debug {
+		fmt.Printf("release dhcp4 lease %s on %s\n", m.lease.IP.IP, m.ifname)
+	}
+	client, err := m.client(true)
+	if err != nil {
+		fmt.Printf("release dhcp4 lease err: %s\n", err)
+		return
+	}
+	defer client.Close()
+
+	release := client.ReleasePacket(&m.ack)
+	for _, opt := range dhcp4Identity() {
+		if opt.Code == dhcp4.OptionClientIdentifier {
+			release.AddOption(opt.Code, opt.Value)
+		}
+	}
+	release.PadToMinSize()
+	if err = client.SendPacket(release); err != nil {
+		fmt.Printf("release dhcp4 lease err: %s\n", err)
+	}
+}
+
+// dhcp4Times returns lease time, T1 and T2 of an ack, zero lease time means
+// the lease never expires.
+func dhcp4Times(ack dhcp4.Packet) (lease, t1, t2 time.Duration) {
+	opts := ack.ParseOptions()
+	seconds := func(code dhcp4.OptionCode) time.Duration {
+		b := opts[code]
+		if len(b) != 4 {
+			return 0
+		}
+		return time.Duration(binary.BigEndian.Uint32(b)) * time.Second
+	}
+
+	b := opts[dhcp4.OptionIPAddressLeaseTime]
+	if len(b) != 4 || binary.BigEndian.Uint32(b) == 0xffffffff {
+		return 0, 0, 0
+	}
+	lease = seconds(dhcp4.OptionIPAddressLeaseTime)
+
+	t1 = seconds(dhcp4.OptionRenewalTimeValue)
+	if t1 == 0 || t1 > lease {
+		t1 = lease / 2
+	}
+	t2 = seconds(dhcp4.OptionRebindingTimeValue)
+	if t2 == 0 || t2 > lease || t2 < t1 {
+		t2 = lease * 7 / 8
+	}
+	return lease, t1, t2
+}
+
+// client returns a dhcp4 client talking to the leasing server when unicast is
+// set, or broadcasting on the link otherwise.
+func (m *dhcp4Manager) client(unicast bool) (*dhcp4client.Client, error) {
+	iface, err := net.InterfaceByName(m.ifname)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn interface {
+		Close() error
+		Write(packet []byte) error
+		ReadFrom() ([]byte, net.IP, error)
+		SetReadTimeout(t time.Duration) error
+	}
+	server := net.IP(m.ack.ParseOptions()[dhcp4.OptionServerIdentifier])
+	if unicast && len(server) == net.IPv4len {
+		conn, err = dhcp4client.NewInetSock(
+			dhcp4client.SetLocalAddr(net.UDPAddr{IP: m.lease.IP.IP, Port: 68}),
+			dhcp4client.SetRemoteAddr(net.UDPAddr{IP: server, Port: 67}))
+	} else {
+		conn, err = newDHCP4Conn(iface.Index)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dhcp4client.New(dhcp4client.HardwareAddr(iface.HardwareAddr), dhcp4client.Timeout(dhcp4Timeout), dhcp4client.Connection(conn))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// extend sends a request for the current address in renewing or rebinding
+// state (RFC 2131 4.3.2) and returns the server answer.
+func (m *dhcp4Manager) extend(rebinding bool) (dhcp4.Packet, error) {
+	client, err := m.client(!rebinding)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	xid := make([]byte, 4)
+	if _, err = rand.Read(xid); err != nil {
+		return nil, err
+	}
+
+	request := dhcp4.NewPacket(dhcp4.BootRequest)
+	request.SetCHAddr(m.ack.CHAddr())
+	request.SetXId(xid)
+	request.SetCIAddr(m.lease.IP.IP)
+	request.AddOption(dhcp4.OptionDHCPMessageType, []byte{byte(dhcp4.Request)})
+	request.AddOption(dhcp4.OptionParameterRequestList, dhcp4RequestParams)
+	addDHCP4Options(&request, dhcp4Identity())
+	request.PadToMinSize()
+	if err = client.SendPacket(request); err != nil {
+		return nil, err
+	}
+	return client.GetAcknowledgement(&request)
+}
+
+// update switches to a new ack, moving the address when the server assigned
+// a different one.
+func (m *dhcp4Manager) update(ack dhcp4.Packet) error {
+	lease, err := parseDHCP4Lease(ack)
+	if err != nil {
+		return err
+	}
+
+	if !lease.IP.IP.Equal(m.lease.IP.IP) || lease.IP.Mask.String() != m.lease.IP.Mask.String() {
+		fmt.Printf("ipv4 lease on %s changed from %s to %s\n", m.ifname, m.lease.IP.String(), lease.IP.String())
+		if err = netlink.AddrDel(m.link, &netlink.Addr{IPNet: &m.lease.IP}); err != nil && err != syscall.EADDRNOTAVAIL {
+			fmt.Printf("ipdel err: %s\n", err)
+		}
+		if err = applyDHCP4Lease(m.link, lease); err != nil {
+			return err
+		}
+	}
+	m.ack = ack
+	m.lease = lease
+	return nil
+}
+
+// rediscover drops the current address and acquires a new lease from scratch.
+func (m *dhcp4Manager) rediscover() error {
+	res := dhcp4Attempt(m.ifname)
+	if res.err != nil {
+		return res.err
+	}
+	defer res.client.Close()
+
+	fmt.Printf("ipv4 lease %s on %s\n", res.lease.IP.String(), m.ifname)
+	if err := applyDHCP4Lease(res.link, res.lease); err != nil {
+		return err
+	}
+	m.link = res.link
+	m.ack = res.ack
+	m.lease = res.lease
+	return nil
+}
+
+func (m *dhcp4Manager) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-m.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (m *dhcp4Manager) run(obtained time.Time) {
+	defer close(m.done)
+
+	for {
+		lease, t1, t2 := dhcp4Times(m.ack)
+		if lease == 0 {
+			<-m.stop
+			return
+		}
+
+		now := time.Now()
+		renew := obtained.Add(t1)
+		rebind := obtained.Add(t2)
+		expire := obtained.Add(lease)
+
+		// wait until T1, afterwards retry at half of the time left until
+		// T2 or expiry
+		var next time.Duration
+		switch {
+		case now.Before(renew):
+			next = renew.Sub(now)
+		case now.Before(expire):
+			limit := expire
+			if now.Before(rebind) {
+				limit = rebind
+			}
+			next = limit.Sub(now) / 2
+			if next < dhcp4MinRetry {
+				next = dhcp4MinRetry
+			}
+			if now.Add(next).After(limit) {
+				next = limit.Sub(now)
+			}
+		default:
+			next = 0
+		}
+		if !m.wait(next) {
+			return
+		}
+
+		now = time.Now()
+		if !now.Before(expire) {
+			fmt.Printf("ipv4 lease %s on %s expired\n", m.lease.IP.String(), m.ifname)
+			if err := m.rediscover(); err != nil {
+				fmt.Printf("dhcp4 %s: %s\n", m.ifname, err)
+				if !m.wait(dhcp4MinRetry) {
+					return
+				}
+				continue
+			}
+			obtained = now
+			continue
+		}
+
+		rebinding := !now.Before(rebind)
+		if debug {
+			fmt.Printf("extend dhcp4 lease %s on %s, rebinding %t\n", m.lease.IP.String(), m.ifname, rebinding)
+		}
+		ack, err := m.extend(rebinding)
+		if err != nil {
+			if debug {
+				fmt.Printf("dhcp4 %s: %s\n", m.ifname, err)
+			}
+			continue
+		}
+
+		opts := ack.ParseOptions()
+		if dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]) == dhcp4.NAK {
+			fmt.Printf("ipv4 lease %s on %s refused by server\n", m.lease.IP.String(), m.ifname)
+			if err = m.rediscover(); err != nil {
+				fmt.Printf("dhcp4 %s: %s\n", m.ifname, err)
+				obtained = time.Time{}
+				continue
+			}
+			obtained = now
+			continue
+		}
+
+		if err = m.update(ack); err != nil {
+			fmt.Printf("dhcp4 %s: %s\n", m.ifname, err)
+			continue
+		}
+		obtained = now
+	}
+}
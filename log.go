@@ -1,12 +1,9 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 )
 
@@ -22,88 +19,43 @@ func logComplete(s string) error {
 	return httplog("complete", s)
 }
 
+// httplog reports to the cloud-config-url server, every message carries the
+// tls verification mode of the installer and the clock correction.
 func httplog(t, s string) error {
-	httpTransport := &http.Transport{
-		Dial:            (&net.Dialer{DualStack: true}).Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	httpClient := &http.Client{Transport: httpTransport, Timeout: 10 * time.Second}
-
-	var host string
-	var port string
-	var ok bool
+	httpClient := &http.Client{Transport: newHTTPTransport(installerProxy()), Timeout: 10 * time.Second}
 
-	ok, metadataUrl := cmdlineVar("cloud-config-url")
+	ok, metadataUrl := cloudConfigURL()
 	if !ok {
 		return fmt.Errorf("no datasource available")
 	}
 
-	u, _ := url.Parse(metadataUrl)
-	if strings.Index(u.Host, ":") > 0 {
-		host, port, _ = net.SplitHostPort(u.Host)
-	} else {
-		host = u.Host
+	switch t {
+	case "error", "fatal", "complete":
+	default:
+		return fmt.Errorf("unknown log level %s", t)
 	}
-	if port == "" {
-		if u.Scheme == "https" {
-			port = "443"
-		} else {
-			port = "80"
-		}
-	}
-
-	addrs, err := net.LookupIP(host)
+	u, err := url.Parse(metadataUrl)
 	if err != nil {
 		return err
 	}
+	values := u.Query()
+	values.Set("action", "log")
+	values.Set("flag", "install_"+t)
+	values.Set("message", s)
+	values.Set("tls", tlsMode())
+	if clockSynced {
+		values.Set("clock_offset", clockOffset.String())
+	}
+	u.RawQuery = values.Encode()
+	logurl := u.String()
 
-	for _, addr := range addrs {
-		if ipv4 && addr.To4() == nil {
-			continue
-		}
-		if ipv6 && addr.To4() != nil {
-			continue
-		}
-
-		logurl := ""
-		switch t {
-		case "error":
-			logurl = metadataUrl + "&action=log&flag=install_error&message=" + url.QueryEscape(s)
-		case "fatal":
-			logurl = metadataUrl + "&action=log&flag=install_fatal&message=" + url.QueryEscape(s)
-		case "complete":
-			logurl = metadataUrl + "&action=log&flag=install_complete&message=" + url.QueryEscape(s)
-		default:
-			return fmt.Errorf("unknown log level %s", t)
-		}
-
-		req, err := http.NewRequest("GET", logurl, nil)
-		if err != nil {
-			if debug {
-				fmt.Printf("http %s\n", err)
-				time.Sleep(10 * time.Second)
-			}
-		}
-		req.URL, err = url.Parse(logurl)
-		if err != nil {
-			if debug {
-				fmt.Printf("http %s\n", err)
-				time.Sleep(10 * time.Second)
-			}
-		}
-		req.URL.Host = net.JoinHostPort(addr.String(), port)
-		req.Host = host
-
-		res, err := httpClient.Do(req)
-		if err != nil {
-			if debug {
-				fmt.Printf("http err %s\n", err)
-				time.Sleep(10 * time.Second)
-			}
-		}
-		if res != nil && res.Body != nil {
-			defer res.Body.Close()
+	res, err := fetch(httpClient, "GET", logurl, fetchAttempts)
+	if err != nil {
+		if debug {
+			fmt.Printf("http err %s\n", err)
 		}
+		return err
 	}
+	res.Body.Close()
 	return nil
 }
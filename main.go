@@ -17,6 +17,11 @@ import (
 func main() {
 	var err error
 
+	if !initMode() {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+	initSystem()
+
 	/*
 		for {
 			_, err := os.Stat("/dev/tty")
@@ -41,7 +46,7 @@ func main() {
 
 	//	fmt.Print("\033[2J")
 
-	var dst string = "/dev/sda"
+	var dst string = installDevice
 	var ostype string = "linux"
 	defer func() {
 		if r := recover(); r != nil {
@@ -68,10 +73,21 @@ Network:
 		err = configNetwork()
 		exit_fail(err)
 
+		// certificates and log timestamps need a sane clock
+		if !clockSynced {
+			if err = syncClock(); err != nil && debug {
+				fmt.Printf("sync clock err: %s\n", err)
+			}
+		}
+
 		if debug {
 			fmt.Printf("get CloudConfig\n")
 		}
-		cloudConfig, err = getCloudConfig(DataSource{})
+		dataSource, dsErr := getDataSource()
+		if debug && dsErr != nil {
+			fmt.Printf("get DataSource err: %s\n", dsErr)
+		}
+		cloudConfig, err = getCloudConfig(dataSource)
 		if err != nil {
 			logError(fmt.Sprintf("get CloudConfig err: %s\n", err))
 			if debug {
@@ -85,6 +101,7 @@ Network:
 
 	if cloudConfig.Bootstrap.Timeout != "" {
 		if dt, err := time.ParseDuration(cloudConfig.Bootstrap.Timeout); err == nil {
+			fetchDeadline = time.Now().Add(dt)
 			go func() {
 				time.Sleep(dt)
 				logFatal("install fail by timeout")
@@ -94,9 +111,10 @@ Network:
 		}
 	}
 
-	src := fmt.Sprintf("%s-%s-%s", cloudConfig.Bootstrap.Name, cloudConfig.Bootstrap.Version, cloudConfig.Bootstrap.Arch)
+	allowToken(cloudConfig.Bootstrap.Fetch...)
+	src := imageName(cloudConfig.Bootstrap)
 	fmt.Printf("install image %s\n", src)
-	err = copyImage(src, dst, cloudConfig.Bootstrap.Fetch)
+	err = copyImage(src, dst, cloudConfig.Bootstrap.Fetch, imageProxy(cloudConfig.Bootstrap))
 	if err != nil {
 		cnt--
 		logError(fmt.Sprintf("copy image err: %s\n", err))
@@ -112,12 +130,7 @@ Network:
 	}
 	fmt.Printf("image installed %s\n", src)
 
-	if strings.Contains(cloudConfig.Bootstrap.Name, "bsd") {
-		ostype = "bsd"
-	}
-	if strings.Contains(cloudConfig.Bootstrap.Name, "ispdn") {
-		ostype = "ispdn"
-	}
+	ostype = osType(cloudConfig.Bootstrap)
 
 	if debug {
 		fmt.Printf("ostype: %s\n", ostype)
@@ -228,8 +241,15 @@ Network:
 						fmt.Printf("set root password\n")
 					}
 
-					stdin.Write([]byte(user.Name + ":" + user.Passwd))
-					c = exec.Command(chpasswd, "-e")
+					if user.Passwd != "" {
+						stdin.Write([]byte(user.Name + ":" + user.Passwd))
+						c = exec.Command(chpasswd, "-e")
+					} else if user.PlainPasswd != "" {
+						stdin.Write([]byte(user.Name + ":" + user.PlainPasswd))
+						c = exec.Command(chpasswd)
+					} else {
+						continue
+					}
 					c.Dir = "/"
 					c.Stdin = stdin
 					c.SysProcAttr = chroot
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// bondParam is a parsed dracut style bond= kernel parameter:
+//
+//	bond=<bondname>[:<bondslaves>:[:<options>[:<mtu>]]]
+//
+// slaves and options are comma separated, bond alone means bond0 over
+// eth0 and eth1 in balance-rr mode.
+type bondParam struct {
+	Name    string
+	Slaves  []string
+	Options []string
+	MTU     int
+}
+
+// vlanParam is a parsed vlan=<vlanname>:<phys> kernel parameter, the vlan id
+// is taken from the name: vlan0005, vlan5, eth0.0005 or eth0.5.
+type vlanParam struct {
+	Name   string
+	Parent string
+	ID     int
+}
+
+// bridgeParam is a parsed bridge=<bridgename>:<ethnames> kernel parameter,
+// bridge alone means br0 over eth0.
+type bridgeParam struct {
+	Name  string
+	Ports []string
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseBondParam(s string) (*bondParam, error) {
+	p := &bondParam{Name: "bond0", Slaves: []string{"eth0", "eth1"}, Options: []string{"mode=balance-rr"}}
+	if s == "" {
+		return p, nil
+	}
+
+	fields := strings.Split(s, ":")
+	if len(fields) > 4 {
+		return nil, fmt.Errorf("invalid bond=%s", s)
+	}
+	p.Name = fields[0]
+	if len(fields) > 1 {
+		p.Slaves = splitList(fields[1])
+	}
+	if len(fields) > 2 && fields[2] != "" {
+		p.Options = splitList(fields[2])
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		mtu, err := strconv.Atoi(fields[3])
+		if err != nil || mtu < 68 {
+			return nil, fmt.Errorf("invalid mtu %s in bond=%s", fields[3], s)
+		}
+		p.MTU = mtu
+	}
+	if p.Name == "" || len(p.Slaves) == 0 {
+		return nil, fmt.Errorf("invalid bond=%s", s)
+	}
+	for _, opt := range p.Options {
+		if !strings.Contains(opt, "=") {
+			return nil, fmt.Errorf("invalid bond option %s in bond=%s", opt, s)
+		}
+	}
+	return p, nil
+}
+
+func parseVlanParam(s string) (*vlanParam, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return nil, fmt.Errorf("invalid vlan=%s", s)
+	}
+	p := &vlanParam{Name: fields[0], Parent: fields[1]}
+
+	var id string
+	switch {
+	case strings.HasPrefix(p.Name, "vlan"):
+		id = strings.TrimPrefix(p.Name, "vlan")
+	case strings.Contains(p.Name, "."):
+		id = p.Name[strings.LastIndex(p.Name, ".")+1:]
+	default:
+		return nil, fmt.Errorf("no vlan id in vlan=%s", s)
+	}
+	vid, err := strconv.Atoi(id)
+	if err != nil || vid < 1 || vid > 4094 {
+		return nil, fmt.Errorf("invalid vlan id %s in vlan=%s", id, s)
+	}
+	p.ID = vid
+	return p, nil
+}
+
+func parseBridgeParam(s string) (*bridgeParam, error) {
+	p := &bridgeParam{Name: "br0", Ports: []string{"eth0"}}
+	if s == "" {
+		return p, nil
+	}
+
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 || fields[0] == "" {
+		return nil, fmt.Errorf("invalid bridge=%s", s)
+	}
+	p.Name = fields[0]
+	p.Ports = splitList(fields[1])
+	if len(p.Ports) == 0 {
+		return nil, fmt.Errorf("invalid bridge=%s", s)
+	}
+	return p, nil
+}
+
+// cmdlineParams returns the values of key=value parameters, an empty value
+// for a bare key.
+func cmdlineParams(key string) []string {
+	values := cmdlineVars(key)
+	if cmdlineBool(key) {
+		values = append(values, "")
+	}
+	return values
+}
+
+// addLink creates link unless a link of that name already exists from an
+// earlier configNetwork run.
+func addLink(link netlink.Link) (netlink.Link, error) {
+	name := link.Attrs().Name
+	if existing, err := netlink.LinkByName(name); err == nil {
+		return existing, nil
+	}
+	if debug {
+		fmt.Printf("add %s link %s\n", link.Type(), name)
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("add %s link %s err: %s", link.Type(), name, err)
+	}
+	return netlink.LinkByName(name)
+}
+
+// enslave attaches the named links to master, links must be down for bonds.
+func enslave(master netlink.Link, names []string) error {
+	for _, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("link %s for %s err: %s", name, master.Attrs().Name, err)
+		}
+		if link.Attrs().MasterIndex == master.Attrs().Index {
+			continue
+		}
+		if debug {
+			fmt.Printf("add %s to %s\n", name, master.Attrs().Name)
+		}
+		if err = netlink.LinkSetDown(link); err != nil {
+			return err
+		}
+		if err = netlink.LinkSetMasterByIndex(link, master.Attrs().Index); err != nil {
+			return fmt.Errorf("set master %s on %s err: %s", master.Attrs().Name, name, err)
+		}
+		if err = netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBondOptions writes bonding options through sysfs, the mode has to be
+// set before any slave is added.
+func setBondOptions(name string, options []string) error {
+	sorted := make([]string, 0, len(options))
+	for _, opt := range options {
+		if strings.HasPrefix(opt, "mode=") {
+			sorted = append([]string{opt}, sorted...)
+		} else {
+			sorted = append(sorted, opt)
+		}
+	}
+
+	for _, opt := range sorted {
+		kv := strings.SplitN(opt, "=", 2)
+		if debug {
+			fmt.Printf("set bond %s %s\n", name, opt)
+		}
+		path := "/sys/class/net/" + name + "/bonding/" + kv[0]
+		if err := ioutil.WriteFile(path, []byte(kv[1]), 0644); err != nil {
+			return fmt.Errorf("set bond option %s on %s err: %s", opt, name, err)
+		}
+	}
+	return nil
+}
+
+// networkVirtual creates the links from bond=, vlan= and bridge= parameters
+// in that order, so vlans may sit on bonds and bridges on both. It returns
+// the links that are not enslaved to another one.
+func networkVirtual() ([]string, error) {
+	var bonds []*bondParam
+	var vlans []*vlanParam
+	var bridges []*bridgeParam
+	var created []string
+	enslaved := make(map[string]bool)
+
+	for _, value := range cmdlineParams("bond") {
+		p, err := parseBondParam(value)
+		if err != nil {
+			return nil, err
+		}
+		bonds = append(bonds, p)
+	}
+	for _, value := range cmdlineVars("vlan") {
+		p, err := parseVlanParam(value)
+		if err != nil {
+			return nil, err
+		}
+		vlans = append(vlans, p)
+	}
+	for _, value := range cmdlineParams("bridge") {
+		p, err := parseBridgeParam(value)
+		if err != nil {
+			return nil, err
+		}
+		bridges = append(bridges, p)
+	}
+
+	for _, p := range bonds {
+		exists := false
+		if _, err := netlink.LinkByName(p.Name); err == nil {
+			exists = true
+		}
+		link, err := addLink(&netlink.Generic{LinkAttrs: netlink.LinkAttrs{Name: p.Name}, LinkType: "bond"})
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if err = setBondOptions(p.Name, p.Options); err != nil {
+				return nil, err
+			}
+		}
+		if p.MTU > 0 {
+			if err = netlink.LinkSetMTU(link, p.MTU); err != nil {
+				return nil, fmt.Errorf("set mtu %d on %s err: %s", p.MTU, p.Name, err)
+			}
+		}
+		if err = enslave(link, p.Slaves); err != nil {
+			return nil, err
+		}
+		for _, name := range p.Slaves {
+			enslaved[name] = true
+		}
+		created = append(created, p.Name)
+	}
+
+	for _, p := range vlans {
+		parent, err := netlink.LinkByName(p.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("parent %s of vlan %s err: %s", p.Parent, p.Name, err)
+		}
+		if err = netlink.LinkSetUp(parent); err != nil {
+			return nil, err
+		}
+		_, err = addLink(&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: p.Name, ParentIndex: parent.Attrs().Index}, VlanId: p.ID})
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, p.Name)
+	}
+
+	for _, p := range bridges {
+		link, err := addLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: p.Name}})
+		if err != nil {
+			return nil, err
+		}
+		if err = enslave(link, p.Ports); err != nil {
+			return nil, err
+		}
+		for _, name := range p.Ports {
+			enslaved[name] = true
+		}
+		created = append(created, p.Name)
+	}
+
+	var ifaces []string
+	for _, name := range created {
+		if !enslaved[name] {
+			ifaces = append(ifaces, name)
+		}
+	}
+	return ifaces, nil
+}
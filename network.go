@@ -1,42 +1,65 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"strings"
 	"time"
 
-	//	"golang.org/x/net/icmp"
-
-	"github.com/d2g/dhcp4"
-	"github.com/d2g/dhcp4client"
 	"github.com/vishvananda/netlink"
 )
 
 var (
 	ipv4 = false
 	ipv6 = false
+
+	// interface the network was configured on
+	netIface string
 )
 
 func configNetwork() (err error) {
 
 	var cmdline_ifaces []string
 	var cmdline_mode string
+	var statics []*ipParam
+	var err4, err6 error
 
-	ok, values := cmdlineVar("ip")
+	netIface = ""
+	virtual, err := networkVirtual()
+	if err != nil {
+		return err
+	}
 
-	if ok {
-		if strings.Index(values, ":") == 0 {
-			cmdline_mode = values
+	for _, values := range cmdlineVars("ip") {
+		param, err := parseIPParam(values)
+		if err != nil {
+			return err
+		}
+		if param.static() {
+			statics = append(statics, param)
+			continue
 		}
-		if strings.Index(values, ":") > 0 {
-			ifparts := strings.SplitN(values, ":", 2)
-			cmdline_ifaces = append(cmdline_ifaces, ifparts[0])
-			cmdline_mode = ifparts[1]
+		if param.Iface != "" {
+			cmdline_ifaces = append(cmdline_ifaces, param.Iface)
 		}
+		switch param.Mode {
+		case "dhcp", "on", "any":
+			cmdline_mode = "dhcp4"
+		default:
+			cmdline_mode = param.Mode
+		}
+	}
+
+	if len(statics) > 0 {
+		err = networkStatic(statics)
+		goto Success
 	}
 
+	if len(cmdline_ifaces) == 0 && len(virtual) > 0 {
+		cmdline_ifaces = virtual
+	}
 	if len(cmdline_ifaces) == 0 {
 		ifaces, err := net.Interfaces()
 		exit_fail(err)
@@ -44,10 +67,9 @@ func configNetwork() (err error) {
 			cmdline_ifaces = append(cmdline_ifaces, iface.Name)
 		}
 	}
-	var err4, err6 error
 
 	if cmdline_mode == "auto6" || cmdline_mode == "dhcp6" || cmdline_mode == "auto" {
-		err6 = networkAuto6(cmdline_ifaces)
+		err6 = networkAuto6(cmdline_ifaces, cmdline_mode == "dhcp6")
 		if err6 == nil {
 			ipv6 = true
 			goto Success
@@ -68,8 +90,13 @@ func configNetwork() (err error) {
 		fmt.Printf("ipv4 error: %s\n", err4.Error())
 	}
 
-	if err4 != nil && err6 != nil {
-		err = fmt.Errorf(err4.Error() + err6.Error())
+	switch {
+	case err4 != nil && err6 != nil:
+		err = fmt.Errorf("%s; %s", err4, err6)
+	case err4 != nil:
+		err = err4
+	case err6 != nil:
+		err = err6
 	}
 
 Success:
@@ -98,51 +125,60 @@ func networkIfacesUp(ifaces []string) (err error) {
 	return nil
 }
 
-func networkAuto6(ifaces []string) error {
-	/*
-		var buffer []byte
-		conn, err := icmp.ListenPacket("ip6:58", "::")
-		if err != nil {
-			return err
-		}
-		defer conn.Close()
-
-		go func() {
-			for {
-				conn.SetDeadline(time.Now().Add(15 * time.Second))
-				n, _, _ := conn.ReadFrom(buffer)
-				if n > 0 {
+func networkAuto6(ifaces []string, stateful bool) error {
+	var errs []string
+	var nameservers []net.IP
+	var search []string
+	configured := false
 
-				}
-			}
-		}()
-	*/
 	exit_fail(networkIfacesUp(ifaces))
 
 	for _, ifname := range ifaces {
 		iface, err := net.InterfaceByName(ifname)
 		exit_fail(err)
 
-		addrs, _ := iface.Addrs()
-		for _, addr := range addrs {
-			a := strings.Split(addr.String(), "/")[0]
-			ip := net.ParseIP(a)
-			if ip == nil {
-				continue
-			}
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
 
-			if ip.To4() != nil {
-				if strings.HasPrefix(a, "fe80") {
-					continue
-				}
-				//nameserver
-				break
+		ns, search6, err := networkAuto6Iface(iface, stateful)
+		if err != nil {
+			if debug {
+				fmt.Printf("ipv6 %s: %s\n", ifname, err)
 			}
+			errs = append(errs, err.Error())
+			continue
+		}
+		if !configured {
+			netIface = ifname
 		}
+		configured = true
+		nameservers = append(nameservers, ns...)
+		search = append(search, search6...)
+	}
+
+	if !configured {
+		return fmt.Errorf("failed to configure ipv6: %s", strings.Join(errs, "; "))
+	}
+
+	if len(nameservers) > 0 {
+		exit_fail(writeResolvConf(nameservers, search))
 	}
 	return nil
 }
 
+func writeResolvConf(nameservers []net.IP, search []string) error {
+	var buf bytes.Buffer
+
+	if len(search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(search, " "))
+	}
+	for _, ns := range nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	return ioutil.WriteFile("/etc/resolv.conf", buf.Bytes(), 0644)
+}
+
 func flushAddr(ifaces []string, family string) (err error) {
 	for _, ifname := range ifaces {
 		iface, err := net.InterfaceByName(ifname)
@@ -179,9 +215,7 @@ func flushAddr(ifaces []string, family string) (err error) {
 				fmt.Printf("link err: %s\n", err.Error())
 			}
 
-			naddr := &netlink.Addr{}
-			naddr.IP = ipnet.IP
-			naddr.Mask = ipnet.Mask
+			naddr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: ipnet.Mask}}
 			err = netlink.AddrDel(link, naddr)
 			if err != nil {
 				fmt.Printf("ipdel err: %s\n", err.Error())
@@ -192,89 +226,86 @@ func flushAddr(ifaces []string, family string) (err error) {
 }
 
 func networkAuto4(ifaces []string) (err error) {
-	err = fmt.Errorf("failed to configure ipv4")
+	var candidates []string
+	var winner *dhcp4Result
+	var errs []string
 
+	stopLeaseManager()
 	exit_fail(networkIfacesUp(ifaces))
-	exit_fail(ioutil.WriteFile("/etc/resolv.conf", []byte(fmt.Sprintf("nameserver 8.8.8.8\nnameserver 8.8.4.4\n")), 0644))
 
 	for _, ifname := range ifaces {
 		iface, err := net.InterfaceByName(ifname)
 		exit_fail(err)
-		link, err := netlink.LinkByName(ifname)
-		exit_fail(err)
 
 		if iface.Flags&net.FlagLoopback == 0 {
-			flushAddr(ifaces, "ipv4")
-			if debug {
-				fmt.Printf("try to get link %+v\n", link)
-			}
+			candidates = append(candidates, ifname)
+		}
+	}
 
-			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
-			exit_fail(err)
+	done := make(chan struct{})
+	defer close(done)
 
-			if debug {
-				fmt.Printf("try to get routes %+v\n", routes)
-			}
+	carrier := watchCarrier(candidates, carrierWait(), done)
+	results := make(chan dhcp4Result, len(candidates))
+	running := 0
 
-			if routes != nil && len(routes) > 0 {
-				for _, route := range routes {
-					if debug {
-						fmt.Printf("try to remove route %s\n", route)
-					}
-					netlink.RouteDel(&route)
-				}
-			}
-
-			if debug {
-				fmt.Printf("add default route to 0.0.0.0\n")
+wait:
+	for carrier != nil || running > 0 {
+		select {
+		case ifname, ok := <-carrier:
+			if !ok {
+				carrier = nil
+				continue
 			}
-			exit_fail(netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &net.IPNet{}, Src: net.ParseIP("0.0.0.0")}))
-
 			if debug {
-				fmt.Printf("send dhcp4 request\n")
-			}
-
-			client, err := dhcp4client.New(dhcp4client.HardwareAddr(iface.HardwareAddr), dhcp4client.Timeout(8*time.Second))
-			if err != nil {
-				return fmt.Errorf("can't create dhcp4 client")
-			}
-			defer client.Close()
-			ok, packet, err := client.Request()
-			if !ok || err != nil {
-				return fmt.Errorf("can't do dhcp request")
+				fmt.Printf("carrier on %s, send dhcp4 request\n", ifname)
 			}
-			opts := packet.ParseOptions()
-
-			ipnet := net.IPNet{
-				IP:   packet.YIAddr(),
-				Mask: net.IPMask(opts[dhcp4.OptionSubnetMask]),
-			}
-			addr, err := netlink.ParseAddr(ipnet.String())
-			exit_fail(err)
-			if debug {
-				fmt.Printf("set addr %s\n", ipnet.String())
+			running++
+			go func(ifname string) {
+				results <- dhcp4Attempt(ifname)
+			}(ifname)
+		case res := <-results:
+			running--
+			if res.err != nil {
+				if debug {
+					fmt.Printf("dhcp4 %s: %s\n", res.ifname, res.err)
+				}
+				errs = append(errs, res.err.Error())
+				continue
 			}
-			exit_fail(netlink.AddrAdd(link, addr))
+			winner = &res
+			break wait
+		}
+	}
 
-			gw := net.IPv4(opts[3][0], opts[3][1], opts[3][2], opts[3][3])
-			r := &netlink.Route{
-				LinkIndex: link.Attrs().Index,
-				Dst:       &net.IPNet{},
-				Gw:        gw,
-			}
-			if debug {
-				fmt.Printf("del default route to 0.0.0.0\n")
+	// release leases of interfaces that answered after the winner
+	go func(running int) {
+		for i := 0; i < running; i++ {
+			res := <-results
+			if res.err != nil {
+				continue
 			}
-			exit_fail(netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Src: net.ParseIP("0.0.0.0"), Dst: &net.IPNet{}}))
-
 			if debug {
-				fmt.Printf("set default route to %s\n", gw.String())
+				fmt.Printf("release dhcp4 lease %s on %s\n", res.lease.IP.IP, res.ifname)
 			}
-			exit_fail(netlink.RouteAdd(r))
+			res.client.Release(res.ack)
+			res.client.Close()
+		}
+	}(running)
 
-			//			ns := net.IPv4(opts[dhcp4.OptionDomainNameServer][0], opts[dhcp4.OptionDomainNameServer][1], opts[dhcp4.OptionDomainNameServer][2], opts[dhcp4.OptionDomainNameServer][3])
-			//			exit_fail(ioutil.WriteFile("/etc/resolv.conf", []byte(fmt.Sprintf("nameserver %s\n", ns)), 0644))
+	if winner == nil {
+		if len(errs) == 0 {
+			return fmt.Errorf("failed to configure ipv4: no carrier on %s", strings.Join(candidates, ", "))
 		}
+		return fmt.Errorf("failed to configure ipv4: %s", strings.Join(errs, "; "))
+	}
+
+	fmt.Printf("ipv4 lease %s on %s\n", winner.lease.IP.String(), winner.ifname)
+	winner.client.Close()
+	if err = applyDHCP4Lease(winner.link, winner.lease); err != nil {
+		return err
 	}
+	netIface = winner.ifname
+	startLeaseManager(winner)
 	return nil
 }
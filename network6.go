@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	icmp6RouterSolicitation  = 133
+	icmp6RouterAdvertisement = 134
+
+	ndOptSourceLinkAddr = 1
+	ndOptPrefixInfo     = 3
+	ndOptMTU            = 5
+	ndOptRDNSS          = 25
+	ndOptDNSSL          = 31
+
+	rsMaxSolicitations = 3
+	rsInterval         = 4 * time.Second
+)
+
+var allRouters = net.ParseIP("ff02::2")
+
+type raPrefix struct {
+	Prefix     net.IPNet
+	OnLink     bool
+	Autonomous bool
+	Valid      uint32
+	Preferred  uint32
+}
+
+type routerAdvert struct {
+	Router   net.IP
+	Managed  bool
+	Other    bool
+	Lifetime time.Duration
+	MTU      uint32
+	Prefixes []raPrefix
+	DNS      []net.IP
+	Search   []string
+}
+
+// parseRA decodes an ICMPv6 router advertisement (RFC 4861 4.2) including
+// prefix information, mtu, rdnss and dnssl (RFC 8106) options.
+func parseRA(b []byte, src net.IP) (*routerAdvert, error) {
+	if len(b) < 16 || b[0] != icmp6RouterAdvertisement || b[1] != 0 {
+		return nil, fmt.Errorf("not a router advertisement")
+	}
+
+	ra := &routerAdvert{
+		Router:   src,
+		Managed:  b[5]&0x80 != 0,
+		Other:    b[5]&0x40 != 0,
+		Lifetime: time.Duration(binary.BigEndian.Uint16(b[6:8])) * time.Second,
+	}
+
+	opts := b[16:]
+	for len(opts) >= 2 {
+		olen := int(opts[1]) * 8
+		if olen == 0 || olen > len(opts) {
+			return nil, fmt.Errorf("malformed router advertisement option %d", opts[0])
+		}
+		data := opts[2:olen]
+		switch opts[0] {
+		case ndOptPrefixInfo:
+			if len(data) < 30 {
+				break
+			}
+			plen := int(data[0])
+			if plen > 128 {
+				break
+			}
+			prefix := make(net.IP, net.IPv6len)
+			copy(prefix, data[14:30])
+			ra.Prefixes = append(ra.Prefixes, raPrefix{
+				Prefix:     net.IPNet{IP: prefix, Mask: net.CIDRMask(plen, 128)},
+				OnLink:     data[1]&0x80 != 0,
+				Autonomous: data[1]&0x40 != 0,
+				Valid:      binary.BigEndian.Uint32(data[2:6]),
+				Preferred:  binary.BigEndian.Uint32(data[6:10]),
+			})
+		case ndOptMTU:
+			if len(data) >= 6 {
+				ra.MTU = binary.BigEndian.Uint32(data[2:6])
+			}
+		case ndOptRDNSS:
+			if len(data) < 6 || binary.BigEndian.Uint32(data[2:6]) == 0 {
+				break
+			}
+			for i := 6; i+net.IPv6len <= len(data); i += net.IPv6len {
+				ns := make(net.IP, net.IPv6len)
+				copy(ns, data[i:i+net.IPv6len])
+				ra.DNS = append(ra.DNS, ns)
+			}
+		case ndOptDNSSL:
+			if len(data) < 6 || binary.BigEndian.Uint32(data[2:6]) == 0 {
+				break
+			}
+			ra.Search = append(ra.Search, parseDomainNames(data[6:])...)
+		}
+		opts = opts[olen:]
+	}
+	return ra, nil
+}
+
+// parseDomainNames decodes a sequence of dns wire format names as used by
+// dnssl, dhcpv6 domain list and dhcpv4 option 119. Compression pointers
+// (RFC 3397) are resolved relative to the start of b.
+func parseDomainNames(b []byte) []string {
+	var names []string
+
+	for i := 0; i < len(b); {
+		if b[i] == 0 {
+			i++
+			continue
+		}
+		name, next, ok := readDomainName(b, i)
+		if !ok {
+			break
+		}
+		names = append(names, name)
+		i = next
+	}
+	return names
+}
+
+func readDomainName(b []byte, i int) (name string, next int, ok bool) {
+	var labels []string
+	next = -1
+
+	for jumps := 0; jumps < len(b); {
+		if i >= len(b) {
+			return "", 0, false
+		}
+		l := int(b[i])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = i + 1
+			}
+			return strings.Join(labels, "."), next, len(labels) > 0
+		case l&0xc0 == 0xc0:
+			if i+1 >= len(b) {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = i + 2
+			}
+			i = (l&0x3f)<<8 | int(b[i+1])
+			jumps++
+		case l&0xc0 != 0 || i+1+l > len(b):
+			return "", 0, false
+		default:
+			labels = append(labels, string(b[i+1:i+1+l]))
+			i += 1 + l
+		}
+	}
+	return "", 0, false
+}
+
+// eui64 builds a slaac address (RFC 4862) from a /64 prefix and mac address.
+func eui64(prefix net.IP, mac net.HardwareAddr) net.IP {
+	if len(mac) != 6 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.To16()[:8])
+	ip[8] = mac[0] ^ 0x02
+	ip[9] = mac[1]
+	ip[10] = mac[2]
+	ip[11] = 0xff
+	ip[12] = 0xfe
+	ip[13] = mac[3]
+	ip[14] = mac[4]
+	ip[15] = mac[5]
+	return ip
+}
+
+// inet6Ready reports whether ifname has an address of the given
+// /proc/net/if_inet6 scope ("20" link, "00" global) that already passed
+// duplicate address detection.
+func inet6Ready(ifname string, scope string) bool {
+	f, err := os.Open("/proc/net/if_inet6")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// fe800000000000000a0027fffe123456 02 40 20 80 eth0
+		fields := strings.Fields(s.Text())
+		if len(fields) != 6 || fields[5] != ifname || fields[3] != scope {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil {
+			continue
+		}
+		if flags&(syscall.IFA_F_TENTATIVE|syscall.IFA_F_DADFAILED) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func icmp6Socket(iface *net.Interface) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return -1, err
+	}
+
+	var filter syscall.ICMPv6Filter
+	for i := range filter.Data {
+		filter.Data[i] = 0xffffffff
+	}
+	filter.Data[icmp6RouterAdvertisement>>5] &^= 1 << (icmp6RouterAdvertisement & 31)
+
+	for _, fn := range []func() error{
+		func() error { return syscall.BindToDevice(fd, iface.Name) },
+		func() error {
+			return syscall.SetsockoptICMPv6Filter(fd, syscall.SOL_ICMPV6, syscall.ICMPV6_FILTER, &filter)
+		},
+		func() error {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255)
+		},
+		func() error {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, 255)
+		},
+		func() error {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index)
+		},
+	} {
+		if err = fn(); err != nil {
+			syscall.Close(fd)
+			return -1, err
+		}
+	}
+	return fd, nil
+}
+
+func sendRS(fd int, iface *net.Interface) error {
+	pkt := []byte{icmp6RouterSolicitation, 0, 0, 0, 0, 0, 0, 0}
+	if len(iface.HardwareAddr) == 6 {
+		pkt = append(pkt, ndOptSourceLinkAddr, 1)
+		pkt = append(pkt, iface.HardwareAddr...)
+	}
+
+	sa := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(sa.Addr[:], allRouters)
+	return syscall.Sendto(fd, pkt, 0, sa)
+}
+
+func recvRA(fd int, timeout time.Duration) (*routerAdvert, error) {
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(timeout)
+
+	for {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, syscall.EAGAIN
+		}
+		tv := syscall.NsecToTimeval(left.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return nil, err
+		}
+
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return nil, err
+		}
+		sa, ok := from.(*syscall.SockaddrInet6)
+		if !ok {
+			continue
+		}
+		src := make(net.IP, net.IPv6len)
+		copy(src, sa.Addr[:])
+		// RFC 4861 6.1.2: router advertisements must come from a link-local address
+		if !src.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ra, err := parseRA(buf[:n], src)
+		if err != nil {
+			if debug {
+				fmt.Printf("ra from %s: %s\n", src, err)
+			}
+			continue
+		}
+		return ra, nil
+	}
+}
+
+// solicitRouter sends router solicitations on iface and waits for the first
+// valid router advertisement.
+func solicitRouter(iface *net.Interface) (*routerAdvert, error) {
+	for i := 0; i < 50 && !inet6Ready(iface.Name, "20"); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fd, err := icmp6Socket(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	for i := 0; i < rsMaxSolicitations; i++ {
+		if debug {
+			fmt.Printf("send router solicitation on %s\n", iface.Name)
+		}
+		if err = sendRS(fd, iface); err != nil {
+			return nil, err
+		}
+		ra, err := recvRA(fd, rsInterval)
+		if err == nil {
+			return ra, nil
+		}
+		if err != syscall.EAGAIN && err != syscall.EWOULDBLOCK {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no router advertisement received on %s", iface.Name)
+}
+
+// networkAuto6Iface configures iface from a router advertisement using
+// stateless autoconfiguration, falling back to dhcpv6 when the router sets
+// the managed flag or stateful configuration is forced.
+func networkAuto6Iface(iface *net.Interface, stateful bool) (nameservers []net.IP, search []string, err error) {
+	link, err := netlink.LinkByName(iface.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ra, err := solicitRouter(iface)
+	if err != nil && !stateful {
+		return nil, nil, err
+	}
+	if ra == nil {
+		if debug {
+			fmt.Printf("%s, trying dhcpv6 without router\n", err)
+		}
+		ra = &routerAdvert{Managed: true}
+	} else if debug {
+		fmt.Printf("ra from %s on %s: %+v\n", ra.Router, iface.Name, ra)
+	}
+
+	if ra.MTU >= 1280 && int(ra.MTU) != iface.MTU {
+		if err = netlink.LinkSetMTU(link, int(ra.MTU)); err != nil {
+			fmt.Printf("set mtu %d on %s err: %s\n", ra.MTU, iface.Name, err)
+		}
+	}
+
+	configured := false
+	for _, p := range ra.Prefixes {
+		ones, _ := p.Prefix.Mask.Size()
+		if p.Valid == 0 || p.Preferred > p.Valid || p.Prefix.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if p.OnLink {
+			r := &netlink.Route{LinkIndex: iface.Index, Dst: &net.IPNet{IP: p.Prefix.IP, Mask: p.Prefix.Mask}}
+			if err = netlink.RouteAdd(r); err != nil && err != syscall.EEXIST {
+				fmt.Printf("route add %s err: %s\n", r.Dst, err)
+			}
+		}
+		if !p.Autonomous || ones != 64 {
+			continue
+		}
+		ip := eui64(p.Prefix.IP, iface.HardwareAddr)
+		if ip == nil {
+			continue
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: p.Prefix.Mask}}
+		if debug {
+			fmt.Printf("set addr %s\n", addr.IPNet)
+		}
+		if err = netlink.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+			fmt.Printf("addr add %s err: %s\n", addr.IPNet, err)
+			continue
+		}
+		configured = true
+	}
+	nameservers = append(nameservers, ra.DNS...)
+	search = append(search, ra.Search...)
+
+	if stateful || ra.Managed {
+		lease, err := networkDHCP6(iface, link)
+		if err != nil {
+			if !configured {
+				return nil, nil, err
+			}
+			fmt.Printf("dhcpv6 on %s err: %s\n", iface.Name, err)
+		} else {
+			configured = true
+			nameservers = append(nameservers, lease.DNS...)
+			search = append(search, lease.Search...)
+		}
+	}
+
+	if !configured {
+		return nil, nil, fmt.Errorf("no autoconfigurable prefix advertised on %s", iface.Name)
+	}
+	for i := 0; i < 50 && !inet6Ready(iface.Name, "00"); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if ra.Router != nil && ra.Lifetime > 0 {
+		if debug {
+			fmt.Printf("set default route to %s\n", ra.Router)
+		}
+		r := &netlink.Route{
+			LinkIndex: iface.Index,
+			Dst:       &net.IPNet{},
+			Gw:        ra.Router,
+		}
+		if err = netlink.RouteAdd(r); err != nil && err != syscall.EEXIST {
+			return nil, nil, fmt.Errorf("default route via %s err: %s", ra.Router, err)
+		}
+	}
+
+	return nameservers, search, nil
+}
+
+func networkDHCP6(iface *net.Interface, link netlink.Link) (*dhcp6Lease, error) {
+	client, err := newDHCP6Client(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	lease, err := client.Request()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range lease.Addrs {
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: a.IP, Mask: net.CIDRMask(128, 128)}}
+		if debug {
+			fmt.Printf("set addr %s\n", addr.IPNet)
+		}
+		if err = netlink.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("addr add %s err: %s", addr.IPNet, err)
+		}
+	}
+	return lease, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ndOption builds a neighbor discovery option padded to 8 byte units.
+func ndOption(typ byte, data []byte) []byte {
+	n := (2 + len(data) + 7) / 8 * 8
+	b := make([]byte, n)
+	b[0] = typ
+	b[1] = byte(n / 8)
+	copy(b[2:], data)
+	return b
+}
+
+func TestParseRA(t *testing.T) {
+	ra := make([]byte, 16)
+	ra[0] = icmp6RouterAdvertisement
+	ra[5] = 0x40 // other configuration
+	binary.BigEndian.PutUint16(ra[6:8], 1800)
+
+	prefix := make([]byte, 30)
+	prefix[0] = 64
+	prefix[1] = 0xc0
+	binary.BigEndian.PutUint32(prefix[2:6], 86400)
+	binary.BigEndian.PutUint32(prefix[6:10], 14400)
+	copy(prefix[14:30], net.ParseIP("2001:db8:1::"))
+	ra = append(ra, ndOption(ndOptPrefixInfo, prefix)...)
+
+	mtu := make([]byte, 6)
+	binary.BigEndian.PutUint32(mtu[2:6], 1480)
+	ra = append(ra, ndOption(ndOptMTU, mtu)...)
+
+	rdnss := make([]byte, 6+2*net.IPv6len)
+	binary.BigEndian.PutUint32(rdnss[2:6], 600)
+	copy(rdnss[6:], net.ParseIP("2001:db8::53"))
+	copy(rdnss[22:], net.ParseIP("2001:db8::54"))
+	ra = append(ra, ndOption(ndOptRDNSS, rdnss)...)
+
+	dnssl := make([]byte, 6)
+	binary.BigEndian.PutUint32(dnssl[2:6], 600)
+	dnssl = append(dnssl, "\x07example\x03com\x00\x03lab\xc0\x00"...)
+	ra = append(ra, ndOption(ndOptDNSSL, dnssl)...)
+
+	// lifetime 0 withdraws the servers
+	ra = append(ra, ndOption(ndOptRDNSS, make([]byte, 6+net.IPv6len))...)
+
+	src := net.ParseIP("fe80::1")
+	got, err := parseRA(ra, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Router.Equal(src) || got.Managed || !got.Other || got.Lifetime != 30*time.Minute || got.MTU != 1480 {
+		t.Errorf("header: %+v", got)
+	}
+	if len(got.Prefixes) != 1 {
+		t.Fatalf("prefixes: %+v", got.Prefixes)
+	}
+	p := got.Prefixes[0]
+	if p.Prefix.String() != "2001:db8:1::/64" || !p.OnLink || !p.Autonomous || p.Valid != 86400 || p.Preferred != 14400 {
+		t.Errorf("prefix: %+v", p)
+	}
+	if len(got.DNS) != 2 || !got.DNS[0].Equal(net.ParseIP("2001:db8::53")) || !got.DNS[1].Equal(net.ParseIP("2001:db8::54")) {
+		t.Errorf("dns: %v", got.DNS)
+	}
+	// the compression pointer is relative to the start of the dnssl names
+	if want := []string{"example.com", "lab.example.com"}; !reflect.DeepEqual(got.Search, want) {
+		t.Errorf("search: %v, want %v", got.Search, want)
+	}
+}
+
+func TestParseRAMalformed(t *testing.T) {
+	ra := make([]byte, 16)
+	ra[0] = icmp6RouterAdvertisement
+	for _, b := range [][]byte{
+		ra[:8],
+		append([]byte{icmp6RouterSolicitation}, ra[1:]...),
+		append(append([]byte{}, ra...), ndOptMTU, 0),
+		append(append([]byte{}, ra...), ndOptMTU, 2, 0, 0, 0, 0, 0, 0),
+	} {
+		if _, err := parseRA(b, nil); err == nil {
+			t.Errorf("parseRA(%x) succeeded", b)
+		}
+	}
+}
+
+func TestParseDomainNames(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{"\x07example\x03com\x00", []string{"example.com"}},
+		{"\x07example\x03com\x00\x00\x00", []string{"example.com"}},
+		{"\x03foo\x07example\x03com\x00\x03bar\xc0\x04", []string{"foo.example.com", "bar.example.com"}},
+		// pointer loops and truncated labels end the list
+		{"\x03foo\xc0\x00", nil},
+		{"\x01a\x00\x05ab", []string{"a"}},
+		{"\x01a\x00\x40", []string{"a"}},
+	} {
+		if got := parseDomainNames([]byte(tt.in)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDomainNames(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEUI64(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	if got := eui64(net.ParseIP("2001:db8:1::"), mac); !got.Equal(net.ParseIP("2001:db8:1::5054:ff:fe12:3456")) {
+		t.Errorf("eui64 = %s", got)
+	}
+	if got := eui64(net.ParseIP("2001:db8:1::"), net.HardwareAddr{1, 2}); got != nil {
+		t.Errorf("eui64 of a short mac = %s", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const nocloudLabel = "cidata"
+
+// parseNocloudMetadata flattens the meta-data yaml of a nocloud seed, lists
+// and maps become path/index keys like public-keys/0, and overlays the
+// h= and i= values given on the kernel cmdline.
+func parseNocloudMetadata(buf []byte, params map[string]string) (map[string]string, error) {
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("meta-data: %s", err)
+	}
+
+	md := make(map[string]string)
+	for k, v := range m {
+		flattenMetadata(k, v, md)
+	}
+	if key, ok := md["public-keys"]; ok {
+		delete(md, "public-keys")
+		md["public-keys/0"] = key
+	}
+
+	for short, long := range map[string]string{"h": "local-hostname", "i": "instance-id"} {
+		if v, ok := params[short]; ok {
+			md[long] = v
+		}
+		if v, ok := params[long]; ok {
+			md[long] = v
+		}
+	}
+	return md, nil
+}
+
+func flattenMetadata(path string, v interface{}, md map[string]string) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for k, child := range v {
+			flattenMetadata(fmt.Sprintf("%s/%v", path, k), child, md)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenMetadata(fmt.Sprintf("%s/%d", path, i), child, md)
+		}
+	case nil:
+	default:
+		md[path] = fmt.Sprintf("%v", v)
+	}
+}
+
+// nocloudDatasource reads meta-data and user-data from the root of a volume
+// labelled cidata, like a seed iso attached to the vm.
+type nocloudDatasource struct {
+	volumes []*volume
+	vol     *volume
+	params  map[string]string
+}
+
+func (n *nocloudDatasource) Type() string {
+	return "nocloud"
+}
+
+func (n *nocloudDatasource) FetchMetadata() (map[string]string, error) {
+	var err error
+	for _, v := range n.volumes {
+		var buf []byte
+		if buf, err = v.ReadFile("meta-data"); err != nil {
+			continue
+		}
+		md, err := parseNocloudMetadata(buf, n.params)
+		if err != nil {
+			return nil, err
+		}
+		n.vol = v
+		return md, nil
+	}
+	return nil, fmt.Errorf("no usable cidata volume: %s", err)
+}
+
+func (n *nocloudDatasource) FetchUserdata() ([]byte, error) {
+	if n.vol == nil {
+		if _, err := n.FetchMetadata(); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := n.vol.ReadFile("user-data")
+	if err != nil {
+		return nil, fmt.Errorf("cidata volume %s has no user-data: %s", n.vol.Dev, err)
+	}
+	return buf, nil
+}
+
+// nocloudNetDatasource reads meta-data and user-data below the seed url
+// given with ds=nocloud-net;s=<url>.
+type nocloudNetDatasource struct {
+	seed   string
+	params map[string]string
+	client *http.Client
+}
+
+func newNocloudNetDatasource(seed string, params map[string]string) *nocloudNetDatasource {
+	if !strings.HasSuffix(seed, "/") {
+		seed += "/"
+	}
+	return &nocloudNetDatasource{seed: seed, params: params, client: newHTTPClient(10 * time.Second)}
+}
+
+func (n *nocloudNetDatasource) Type() string {
+	return "nocloud-net"
+}
+
+func (n *nocloudNetDatasource) FetchMetadata() (map[string]string, error) {
+	buf, err := httpGet(n.client, n.seed+"meta-data")
+	if err != nil {
+		return nil, err
+	}
+	return parseNocloudMetadata(buf, n.params)
+}
+
+func (n *nocloudNetDatasource) FetchUserdata() ([]byte, error) {
+	return httpGet(n.client, n.seed+"user-data")
+}
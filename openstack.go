@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	configDriveLabel = "config-2"
+
+	openstackMetadataPath = "/openstack/latest/meta_data.json"
+	openstackUserdataPath = "/openstack/latest/user_data"
+)
+
+type openstackMetadata struct {
+	UUID             string            `json:"uuid"`
+	Hostname         string            `json:"hostname"`
+	Name             string            `json:"name"`
+	AvailabilityZone string            `json:"availability_zone"`
+	AdminPass        string            `json:"admin_pass"`
+	PublicKeys       map[string]string `json:"public_keys"`
+	Keys             []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+		Data string `json:"data"`
+	} `json:"keys"`
+	Meta map[string]string `json:"meta"`
+}
+
+// parseOpenstackMetadata flattens meta_data.json into the key layout of
+// the ec2 metadata service used by applyMetadata.
+func parseOpenstackMetadata(buf []byte) (map[string]string, error) {
+	var m openstackMetadata
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("meta_data.json: %s", err)
+	}
+
+	md := map[string]string{
+		"instance-id":       m.UUID,
+		"hostname":          m.Hostname,
+		"name":              m.Name,
+		"availability-zone": m.AvailabilityZone,
+	}
+	if md["hostname"] == "" {
+		md["hostname"] = m.Name
+	}
+	if m.AdminPass != "" {
+		md["admin_pass"] = m.AdminPass
+	}
+	for name, key := range m.PublicKeys {
+		md["public-keys/"+name] = key
+	}
+	for _, key := range m.Keys {
+		if key.Type == "ssh" || key.Type == "" {
+			md["public-keys/"+key.Name] = key.Data
+		}
+	}
+	for k, v := range m.Meta {
+		md["meta/"+k] = v
+	}
+	return md, nil
+}
+
+// configDriveDatasource reads an openstack config drive, an iso9660 or vfat
+// filesystem labelled config-2.
+type configDriveDatasource struct {
+	volumes []*volume
+	vol     *volume
+}
+
+func (c *configDriveDatasource) Type() string {
+	return "configdrive"
+}
+
+func (c *configDriveDatasource) FetchMetadata() (map[string]string, error) {
+	var err error
+	for _, v := range c.volumes {
+		var buf []byte
+		if buf, err = v.ReadFile(openstackMetadataPath); err != nil {
+			continue
+		}
+		md, err := parseOpenstackMetadata(buf)
+		if err != nil {
+			return nil, err
+		}
+		c.vol = v
+		return md, nil
+	}
+	return nil, fmt.Errorf("no usable config drive: %s", err)
+}
+
+func (c *configDriveDatasource) FetchUserdata() ([]byte, error) {
+	if c.vol == nil {
+		if _, err := c.FetchMetadata(); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := c.vol.ReadFile(openstackUserdataPath)
+	if err != nil {
+		return nil, fmt.Errorf("config drive %s has no user_data: %s", c.vol.Dev, err)
+	}
+	return buf, nil
+}
+
+// openstackDatasource reads the openstack metadata service, it shares the
+// timeouts and urls of the ec2 configuration.
+type openstackDatasource struct {
+	urls    []string
+	maxWait time.Duration
+	client  *http.Client
+	base    string
+}
+
+func newOpenstackDatasource(cfg Ec2) *openstackDatasource {
+	e := newEc2Datasource(cfg)
+	o := &openstackDatasource{maxWait: e.maxWait, client: e.client}
+	for _, u := range e.urls {
+		o.urls = append(o.urls, strings.TrimRight(u, "/"))
+	}
+	return o
+}
+
+func (o *openstackDatasource) Type() string {
+	return "openstack"
+}
+
+func (o *openstackDatasource) FetchMetadata() (map[string]string, error) {
+	if o.base == "" {
+		base, err := waitForURL(o.client, o.urls, openstackMetadataPath, o.maxWait)
+		if err != nil {
+			return nil, err
+		}
+		o.base = base
+	}
+	buf, err := httpGet(o.client, o.base+openstackMetadataPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseOpenstackMetadata(buf)
+}
+
+func (o *openstackDatasource) FetchUserdata() ([]byte, error) {
+	if o.base == "" {
+		if _, err := o.FetchMetadata(); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := httpGet(o.client, o.base+openstackUserdataPath)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("openstack instance has no user_data")
+	}
+	return buf, err
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// size of the ranges an image is split into
+	rangeChunk = 4 << 20
+	// concurrent range requests per mirror
+	rangeWorkers = 4
+	// time to fetch one range before it is given to another worker
+	rangeTimeout = 2 * time.Minute
+	// a mirror this many times slower than the fastest keeps one worker
+	slowMirrorFactor = 4
+)
+
+// mirror is a server of the image with its download statistics, updated
+// atomically by its workers.
+type mirror struct {
+	url       string
+	validator string
+
+	bytes   int64
+	nanos   int64
+	chunks  int64
+	workers int32
+}
+
+// rate returns the bytes per nanosecond of one request to the mirror, 0
+// until a few ranges were fetched.
+func (m *mirror) rate() float64 {
+	if atomic.LoadInt64(&m.chunks) < 2 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&m.bytes)) / float64(atomic.LoadInt64(&m.nanos))
+}
+
+// leave removes a worker from the mirror unless it is the last one.
+func (m *mirror) leave() bool {
+	for {
+		n := atomic.LoadInt32(&m.workers)
+		if n <= 1 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&m.workers, n, n-1) {
+			return true
+		}
+	}
+}
+
+type rangeChunkResult struct {
+	index int
+	data  []byte
+}
+
+// parallelReader downloads an image in ranges from all mirrors at once and
+// returns them in order. At most window ranges are in flight or waiting to
+// be read, a range failing on one mirror is retried on any other.
+type parallelReader struct {
+	client  *http.Client
+	mirrors []*mirror
+	size    int64
+	chunks  int
+
+	tokens  chan struct{}
+	jobs    chan int
+	retry   chan int
+	results chan rangeChunkResult
+	exits   chan error
+	quit    chan struct{}
+
+	// owned by Read
+	next    int
+	done    map[int][]byte
+	buf     []byte
+	alive   int
+	lastErr error
+}
+
+// newParallelReader checks which of urls serve the same image with ranges
+// and starts the download from them.
+func newParallelReader(client *http.Client, urls []string) (*parallelReader, error) {
+	c := *client
+	c.Timeout = rangeTimeout
+	r := &parallelReader{client: &c, size: -1}
+
+	for _, u := range urls {
+		res, err := fetch(client, "HEAD", u, 1)
+		if err != nil {
+			if debug {
+				fmt.Printf("mirror %s\n", err)
+			}
+			continue
+		}
+		res.Body.Close()
+		if !strings.Contains(res.Header.Get("Accept-Ranges"), "bytes") || res.ContentLength <= 0 {
+			if debug {
+				fmt.Printf("mirror %s does not serve ranges\n", u)
+			}
+			continue
+		}
+		if r.size < 0 {
+			r.size = res.ContentLength
+		} else if res.ContentLength != r.size {
+			fmt.Printf("mirror %s size %d differs from %d\n", u, res.ContentLength, r.size)
+			continue
+		}
+		m := &mirror{url: u}
+		if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			m.validator = etag
+		} else {
+			m.validator = res.Header.Get("Last-Modified")
+		}
+		r.mirrors = append(r.mirrors, m)
+	}
+	if len(r.mirrors) == 0 {
+		return nil, fmt.Errorf("no mirror serves ranges")
+	}
+
+	r.alive = len(r.mirrors) * rangeWorkers
+	window := 2 * r.alive
+	r.chunks = int((r.size + rangeChunk - 1) / rangeChunk)
+	r.tokens = make(chan struct{}, window)
+	r.jobs = make(chan int)
+	r.retry = make(chan int, window)
+	r.results = make(chan rangeChunkResult, window)
+	r.exits = make(chan error, r.alive)
+	r.quit = make(chan struct{})
+	r.done = make(map[int][]byte)
+
+	go r.dispatch()
+	for _, m := range r.mirrors {
+		m.workers = rangeWorkers
+		for i := 0; i < rangeWorkers; i++ {
+			go r.worker(m)
+		}
+	}
+	return r, nil
+}
+
+// dispatch hands out the ranges in order as the window allows.
+func (r *parallelReader) dispatch() {
+	defer close(r.jobs)
+	for i := 0; i < r.chunks; i++ {
+		select {
+		case r.tokens <- struct{}{}:
+		case <-r.quit:
+			return
+		}
+		select {
+		case r.jobs <- i:
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// slow reports whether another mirror is much faster than m.
+func (r *parallelReader) slow(m *mirror) bool {
+	rate := m.rate()
+	if rate == 0 {
+		return false
+	}
+	for _, o := range r.mirrors {
+		if o.rate() > rate*slowMirrorFactor {
+			return true
+		}
+	}
+	return false
+}
+
+// worker fetches ranges from m, retried ones first, until the reader is
+// closed, the mirror is demoted or fails repeatedly.
+func (r *parallelReader) worker(m *mirror) {
+	jobs := r.jobs
+	failures := 0
+	for {
+		if r.slow(m) && m.leave() {
+			if debug {
+				fmt.Printf("mirror %s demoted\n", m.url)
+			}
+			r.exits <- nil
+			return
+		}
+
+		var i int
+		select {
+		case i = <-r.retry:
+		default:
+			select {
+			case i = <-r.retry:
+			case j, ok := <-jobs:
+				if !ok {
+					jobs = nil
+					continue
+				}
+				i = j
+			case <-r.quit:
+				return
+			}
+		}
+
+		data, err := r.fetchChunk(m, i)
+		if err != nil {
+			fmt.Printf("mirror %s range %d: %s\n", m.url, i, err)
+			r.retry <- i
+			if failures++; failures >= fetchAttempts {
+				atomic.AddInt32(&m.workers, -1)
+				r.exits <- err
+				return
+			}
+			continue
+		}
+		failures = 0
+		r.results <- rangeChunkResult{i, data}
+	}
+}
+
+func (r *parallelReader) fetchChunk(m *mirror, i int) ([]byte, error) {
+	start := int64(i) * rangeChunk
+	end := start + rangeChunk
+	if end > r.size {
+		end = r.size
+	}
+
+	req, err := http.NewRequest("GET", m.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if m.validator != "" {
+		req.Header.Set("If-Range", m.validator)
+	}
+
+	t := time.Now()
+	res, err := fetchDo(r.client, req, fetchAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end-1)) {
+		return nil, fmt.Errorf("range %d-%d not served: %s", start, end-1, res.Status)
+	}
+	data := make([]byte, end-start)
+	if _, err = io.ReadFull(res.Body, data); err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&m.bytes, end-start)
+	atomic.AddInt64(&m.nanos, int64(time.Since(t)))
+	atomic.AddInt64(&m.chunks, 1)
+	return data, nil
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next == r.chunks {
+			return 0, io.EOF
+		}
+		if data, ok := r.done[r.next]; ok {
+			delete(r.done, r.next)
+			r.buf = data
+			r.next++
+			<-r.tokens
+			continue
+		}
+		select {
+		case c := <-r.results:
+			r.done[c.index] = c.data
+		case err := <-r.exits:
+			if err != nil {
+				r.lastErr = err
+			}
+			if r.alive--; r.alive == 0 {
+				return 0, fmt.Errorf("all mirrors failed: %s", r.lastErr)
+			}
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *parallelReader) Close() error {
+	select {
+	case <-r.quit:
+	default:
+		close(r.quit)
+	}
+	return nil
+}
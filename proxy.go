@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseProxy parses a proxy given as http://[user:pass@]host[:port] or
+// host:port, an empty string means no proxy.
+func parseProxy(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %s", s, err)
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %s: only http proxies are supported", s)
+	}
+	return u, nil
+}
+
+// installerProxy returns the proxy= parameter used for config, log and
+// image requests.
+func installerProxy() string {
+	_, proxy := cmdlineVar("proxy")
+	return proxy
+}
+
+// imageProxy returns the proxy of the cloud-config for image requests,
+// falling back to the proxy= parameter.
+func imageProxy(b Bootstrap) string {
+	if b.Proxy != "" {
+		return b.Proxy
+	}
+	return installerProxy()
+}
+
+// noProxy reports whether host is reached directly, either a loopback
+// address or listed in no_proxy= as *, a domain with its subdomains or a
+// network in cidr notation.
+func noProxy(host string) bool {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, value := range cmdlineVars("no_proxy") {
+		for _, p := range splitList(value) {
+			p = strings.ToLower(strings.TrimSpace(p))
+			if p == "*" {
+				return true
+			}
+			if strings.Contains(p, "/") {
+				if _, n, err := net.ParseCIDR(p); err == nil && ip != nil && n.Contains(ip) {
+					return true
+				}
+				continue
+			}
+			p = strings.TrimPrefix(p, ".")
+			if host == p || strings.HasSuffix(host, "."+p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostname strips the port from hostport, host[:port] or [ipv6][:port].
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
+
+// proxyAddr returns host:port of the proxy, port 80 if none is given.
+func proxyAddr(proxy *url.URL) string {
+	if _, _, err := net.SplitHostPort(proxy.Host); err == nil {
+		return proxy.Host
+	}
+	return net.JoinHostPort(strings.Trim(proxy.Host, "[]"), "80")
+}
+
+// dialProxy opens a tunnel to addr through the proxy with CONNECT.
+func dialProxy(proxy *url.URL, network, addr string) (net.Conn, error) {
+	conn, err := dialHost(network, proxyAddr(proxy))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the proxy sends nothing after the response before the tls handshake,
+	// so the reader does not buffer any tunneled bytes and the body is left
+	// alone as it would be read until the tunnel closes
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", proxy.Host, addr, res.Status)
+	}
+	return conn, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	qcow2Magic = "QFI\xfb"
+
+	// clusters passed before the tables mapping them are kept in memory up
+	// to this size, images written by qemu-img put the tables first
+	qcow2MaxRetained = 256 << 20
+
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2CompressedFlag = 1 << 62
+	qcow2ZeroFlag       = 1
+
+	// incompatible features understood, the dirty bit only concerns the
+	// refcounts which are not used here
+	qcow2IncompatDirty = 1 << 0
+)
+
+// qcow2Header holds the fields of the qcow2 header common to v2 and v3.
+type qcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+// qcow2Extent is a byte range of the image file still to be read, the L1
+// table, an L2 table or a data cluster, possibly compressed.
+type qcow2Extent struct {
+	off    int64
+	buf    []byte
+	filled int
+	done   func([]byte) error
+
+	// compressed data may end before the sectors it is said to occupy if
+	// it is at the end of the file
+	short bool
+}
+
+// qcow2Writer reads a qcow2 image as a stream and writes the allocated
+// clusters at their guest offsets. The image is read one host cluster at
+// a time, clusters are matched against the extents known from the tables
+// read so far, unknown ones are kept until all tables are read.
+type qcow2Writer struct {
+	w        io.WriterAt
+	progress io.Writer
+
+	clusterBits uint
+	clusterSize int64
+	size        int64
+
+	cur      int64
+	pending  map[int64][]*qcow2Extent
+	open     map[*qcow2Extent]bool
+	tables   int
+	retained map[int64][]byte
+	kept     int
+}
+
+// writeQcow2 writes the qcow2 image in r to w. Images with a backing file,
+// encryption or other than zlib compression are refused.
+func writeQcow2(r io.Reader, w io.WriterAt, progress io.Writer) error {
+	var hdr qcow2Header
+	head := make([]byte, 512)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return fmt.Errorf("qcow2 header: %s", err)
+	}
+	binary.Read(bytes.NewReader(head), binary.BigEndian, &hdr)
+
+	if string(hdr.Magic[:]) != qcow2Magic {
+		return fmt.Errorf("not a qcow2 image")
+	}
+	if hdr.Version != 2 && hdr.Version != 3 {
+		return fmt.Errorf("qcow2 version %d not supported", hdr.Version)
+	}
+	if hdr.BackingFileOffset != 0 {
+		return fmt.Errorf("qcow2 images with a backing file are not supported")
+	}
+	if hdr.CryptMethod != 0 {
+		return fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+	if hdr.ClusterBits < 9 || hdr.ClusterBits > 21 {
+		return fmt.Errorf("qcow2 cluster bits %d out of range", hdr.ClusterBits)
+	}
+	if hdr.Version == 3 {
+		// incompatible features, the compression type is zlib unless bit 3
+		if incompat := binary.BigEndian.Uint64(head[72:80]); incompat&^qcow2IncompatDirty != 0 {
+			return fmt.Errorf("qcow2 incompatible features %#x not supported", incompat)
+		}
+	}
+
+	q := &qcow2Writer{
+		w:           w,
+		progress:    progress,
+		clusterBits: uint(hdr.ClusterBits),
+		clusterSize: 1 << hdr.ClusterBits,
+		size:        int64(hdr.Size),
+		pending:     make(map[int64][]*qcow2Extent),
+		open:        make(map[*qcow2Extent]bool),
+		retained:    make(map[int64][]byte),
+	}
+	l1 := &qcow2Extent{off: int64(hdr.L1TableOffset), buf: make([]byte, 8*int64(hdr.L1Size)), done: q.readL1}
+	q.tables++
+	if err := q.add(l1); err != nil {
+		return err
+	}
+
+	// the header is the start of the first cluster
+	buf := make([]byte, q.clusterSize)
+	copy(buf, head)
+	if _, err := io.ReadFull(r, buf[len(head):]); err != nil {
+		return fmt.Errorf("qcow2 header: %s", err)
+	}
+	if err := q.cluster(buf); err != nil {
+		return err
+	}
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := q.cluster(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return q.finish()
+}
+
+// finish completes the compressed clusters at the end of the file.
+func (q *qcow2Writer) finish() error {
+	for e := range q.open {
+		if !e.short {
+			return fmt.Errorf("qcow2 image truncated at %d", e.off+int64(e.filled))
+		}
+		if err := e.done(e.buf[:e.filled]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add registers e with the clusters it spans, filling it right away from
+// the retained clusters already passed.
+func (q *qcow2Writer) add(e *qcow2Extent) error {
+	if len(e.buf) == 0 {
+		return e.done(e.buf)
+	}
+	q.open[e] = true
+	end := e.off + int64(len(e.buf))
+	for c := e.off / q.clusterSize; c*q.clusterSize < end; c++ {
+		if c >= q.cur {
+			q.pending[c] = append(q.pending[c], e)
+			continue
+		}
+		data, ok := q.retained[c]
+		if !ok {
+			return fmt.Errorf("qcow2 cluster at %d needed after it was passed", c*q.clusterSize)
+		}
+		if err := q.fill(e, c, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill copies the part of e in host cluster c and completes e once it has
+// all its bytes.
+func (q *qcow2Writer) fill(e *qcow2Extent, c int64, data []byte) error {
+	start := c * q.clusterSize
+	from, to := e.off-start, e.off+int64(len(e.buf))-start
+	if from < 0 {
+		from = 0
+	}
+	if to > int64(len(data)) {
+		to = int64(len(data))
+	}
+	if from >= to {
+		return nil
+	}
+	e.filled += copy(e.buf[start+from-e.off:], data[from:to])
+	if e.filled < len(e.buf) {
+		return nil
+	}
+	delete(q.open, e)
+	return e.done(e.buf)
+}
+
+// cluster handles the next host cluster of the image.
+func (q *qcow2Writer) cluster(data []byte) error {
+	c := q.cur
+	q.cur++
+	extents := q.pending[c]
+	delete(q.pending, c)
+
+	// tables completed here may point back into this cluster
+	q.retained[c] = data
+	for _, e := range extents {
+		if err := q.fill(e, c, data); err != nil {
+			return err
+		}
+	}
+	delete(q.retained, c)
+
+	if q.tables == 0 {
+		// all tables are read, nothing passed is needed any more
+		if len(q.retained) > 0 {
+			q.retained = make(map[int64][]byte)
+			q.kept = 0
+		}
+		return nil
+	}
+
+	// compressed clusters mapped by tables still to be read may share this
+	// cluster with the extents filled above
+	q.kept += len(data)
+	if q.kept > qcow2MaxRetained {
+		return fmt.Errorf("qcow2 tables are after more than %d bytes of data", qcow2MaxRetained)
+	}
+	q.retained[c] = append([]byte(nil), data...)
+	return nil
+}
+
+func (q *qcow2Writer) readL1(buf []byte) error {
+	q.tables--
+	for i := 0; i < len(buf); i += 8 {
+		off := int64(binary.BigEndian.Uint64(buf[i:]) & qcow2OffsetMask)
+		if off == 0 {
+			continue
+		}
+		guest := int64(i/8) * (q.clusterSize / 8) * q.clusterSize
+		l2 := &qcow2Extent{off: off, buf: make([]byte, q.clusterSize)}
+		l2.done = func(buf []byte) error { return q.readL2(buf, guest) }
+		q.tables++
+		if err := q.add(l2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readL2 adds the data clusters of the L2 table mapping the guest offsets
+// from base.
+func (q *qcow2Writer) readL2(buf []byte, base int64) error {
+	q.tables--
+	for i := 0; i < len(buf); i += 8 {
+		entry := binary.BigEndian.Uint64(buf[i:])
+		guest := base + int64(i/8)*q.clusterSize
+		if guest >= q.size {
+			break
+		}
+
+		var e *qcow2Extent
+		if entry&qcow2CompressedFlag != 0 {
+			// host offset and count of additional 512 byte sectors
+			bits := 62 - (q.clusterBits - 8)
+			off := int64(entry & (1<<bits - 1))
+			sectors := int64(entry>>bits) & (1<<(62-bits) - 1)
+			size := (sectors+1)*512 - off&511
+			e = &qcow2Extent{off: off, buf: make([]byte, size), short: true}
+			e.done = func(buf []byte) error { return q.inflate(buf, guest) }
+		} else {
+			off := int64(entry & qcow2OffsetMask)
+			if off == 0 || entry&qcow2ZeroFlag != 0 {
+				continue
+			}
+			e = &qcow2Extent{off: off, buf: make([]byte, q.clusterSize)}
+			e.done = func(buf []byte) error { return q.write(buf, guest) }
+		}
+		if err := q.add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inflate decompresses a cluster stored as raw deflate data.
+func (q *qcow2Writer) inflate(buf []byte, guest int64) error {
+	data := make([]byte, q.clusterSize)
+	fr := flate.NewReader(bytes.NewReader(buf))
+	defer fr.Close()
+	if _, err := io.ReadFull(fr, data); err != nil {
+		return fmt.Errorf("qcow2 compressed cluster at %d: %s", guest, err)
+	}
+	return q.write(data, guest)
+}
+
+// write writes the cluster at guest, cut at the end of the disk image.
+func (q *qcow2Writer) write(data []byte, guest int64) error {
+	if rest := q.size - guest; int64(len(data)) > rest {
+		data = data[:rest]
+	}
+	if _, err := q.w.WriteAt(data, guest); err != nil {
+		return err
+	}
+	if q.progress != nil {
+		q.progress.Write(data)
+	}
+	return nil
+}
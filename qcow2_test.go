@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+// memDisk is a disk in memory growing with the writes.
+type memDisk struct {
+	buf []byte
+}
+
+func (d *memDisk) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(d.buf) {
+		d.buf = append(d.buf, make([]byte, end-len(d.buf))...)
+	}
+	return copy(d.buf[off:], p), nil
+}
+
+// testPattern returns n bytes counting up from seed, compressible enough
+// for a deflated 512 byte cluster to fit in a sector.
+func testPattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = seed + byte(i/64)
+	}
+	return b
+}
+
+// qcow2TestImage builds a v2 image of 512 byte clusters mapping guest
+// cluster 0 to a data cluster, 1 to zeros and 2 to a compressed cluster at
+// the end of the file. With tablesLast the L2 and L1 tables follow the data.
+func qcow2TestImage(t *testing.T, size int64, tablesLast bool) ([]byte, []byte) {
+	data := testPattern(512, 1)
+	compressed := testPattern(512, 100)
+	var zbuf bytes.Buffer
+	fw, _ := flate.NewWriter(&zbuf, flate.BestCompression)
+	fw.Write(compressed)
+	fw.Close()
+	if zbuf.Len() > 512 {
+		t.Fatalf("compressed cluster of %d bytes", zbuf.Len())
+	}
+
+	// host clusters after the header
+	l1c, l2c, datac, zc := int64(1), int64(2), int64(3), int64(4)
+	if tablesLast {
+		datac, l2c, l1c, zc = 1, 2, 3, 4
+	}
+
+	hdr := qcow2Header{Version: 2, ClusterBits: 9, Size: uint64(size), L1Size: 1, L1TableOffset: uint64(l1c * 512)}
+	copy(hdr.Magic[:], qcow2Magic)
+	img := make([]byte, 4*512)
+	var hbuf bytes.Buffer
+	binary.Write(&hbuf, binary.BigEndian, &hdr)
+	copy(img, hbuf.Bytes())
+
+	binary.BigEndian.PutUint64(img[l1c*512:], uint64(l2c*512))
+	l2 := img[l2c*512:]
+	binary.BigEndian.PutUint64(l2[0:], uint64(datac*512))
+	binary.BigEndian.PutUint64(l2[8:], qcow2ZeroFlag)
+	binary.BigEndian.PutUint64(l2[16:], qcow2CompressedFlag|uint64(zc*512))
+	copy(img[datac*512:], data)
+	img = append(img, zbuf.Bytes()...)
+
+	want := make([]byte, size)
+	copy(want, data)
+	copy(want[1024:], compressed)
+	return img, want
+}
+
+func TestWriteQcow2(t *testing.T) {
+	for _, tablesLast := range []bool{false, true} {
+		// the compressed cluster is cut at the end of the disk
+		img, want := qcow2TestImage(t, 1300, tablesLast)
+		d := &memDisk{}
+		var progress bytes.Buffer
+		if err := writeQcow2(bytes.NewReader(img), d, &progress); err != nil {
+			t.Fatalf("tables last %v: %s", tablesLast, err)
+		}
+		if !bytes.Equal(d.buf, want) {
+			t.Errorf("tables last %v: disk differs", tablesLast)
+		}
+		if progress.Len() != 512+276 {
+			t.Errorf("tables last %v: progress %d bytes", tablesLast, progress.Len())
+		}
+	}
+}
+
+func TestWriteQcow2Refused(t *testing.T) {
+	img, _ := qcow2TestImage(t, 2048, false)
+	for _, tt := range []struct {
+		name string
+		off  int
+		val  uint32
+	}{
+		{"magic", 0, 0},
+		{"version", 4, 4},
+		{"backing file", 12, 512},
+		{"cluster bits", 20, 8},
+		{"encryption", 32, 1},
+	} {
+		bad := append([]byte(nil), img...)
+		binary.BigEndian.PutUint32(bad[tt.off:], tt.val)
+		if err := writeQcow2(bytes.NewReader(bad), &memDisk{}, nil); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+	if err := writeQcow2(bytes.NewReader(img[:3*512]), &memDisk{}, nil); err == nil {
+		t.Errorf("truncated image accepted")
+	}
+}
+
+// TestWriteQcow2SharedCompressed writes two compressed clusters stored in
+// the same host cluster, one mapped by an L2 table before it and one by an
+// L2 table after it.
+func TestWriteQcow2SharedCompressed(t *testing.T) {
+	deflate := func(data []byte) []byte {
+		var b bytes.Buffer
+		fw, _ := flate.NewWriter(&b, flate.BestCompression)
+		fw.Write(data)
+		fw.Close()
+		return b.Bytes()
+	}
+	first, second := testPattern(512, 1), testPattern(512, 100)
+	zfirst, zsecond := deflate(first), deflate(second)
+	if len(zfirst) > 200 || len(zsecond) > 312 {
+		t.Fatalf("compressed clusters of %d and %d bytes", len(zfirst), len(zsecond))
+	}
+
+	// header, L1, L2 of guest clusters 0-63, both compressed clusters and
+	// the L2 of guest cluster 64
+	size := int64(65 * 512)
+	hdr := qcow2Header{Version: 2, ClusterBits: 9, Size: uint64(size), L1Size: 2, L1TableOffset: 512}
+	copy(hdr.Magic[:], qcow2Magic)
+	img := make([]byte, 5*512)
+	var hbuf bytes.Buffer
+	binary.Write(&hbuf, binary.BigEndian, &hdr)
+	copy(img, hbuf.Bytes())
+
+	binary.BigEndian.PutUint64(img[512:], 2*512)
+	binary.BigEndian.PutUint64(img[520:], 4*512)
+	binary.BigEndian.PutUint64(img[2*512:], qcow2CompressedFlag|3*512)
+	binary.BigEndian.PutUint64(img[4*512:], qcow2CompressedFlag|(3*512+200))
+	copy(img[3*512:], zfirst)
+	copy(img[3*512+200:], zsecond)
+
+	d := &memDisk{}
+	if err := writeQcow2(bytes.NewReader(img), d, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	copy(want, first)
+	copy(want[64*512:], second)
+	if !bytes.Equal(d.buf, want) {
+		t.Errorf("disk differs")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// resumeReader reads an image over http and when the connection breaks
+// requests the rest with a Range starting at the offset read so far. The
+// checksum and the decompressor above it see every byte exactly once, so
+// their state carries over a resume.
+type resumeReader struct {
+	client *http.Client
+	url    string
+	body   io.ReadCloser
+
+	// off is the offset of the next byte in the compressed image, size the
+	// length of the image or -1 if the server did not tell
+	off  int64
+	size int64
+
+	// validator is the ETag or Last-Modified of the first response, a resume
+	// fails instead of mixing two versions of the image if it changed
+	validator string
+
+	// resumes without progress in between
+	failures int
+}
+
+func newResumeReader(client *http.Client, rawurl string) (*resumeReader, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	// offsets count the bytes as stored, not transparently gunzipped
+	req.Header.Set("Accept-Encoding", "identity")
+	res, err := fetchDo(client, req, fetchAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &resumeReader{client: client, url: rawurl, body: res.Body, size: res.ContentLength}
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		r.validator = etag
+	} else {
+		r.validator = res.Header.Get("Last-Modified")
+	}
+	return r, nil
+}
+
+func (r *resumeReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.off += int64(n)
+		if n > 0 {
+			r.failures = 0
+		}
+		if err == nil || err == io.EOF && (r.size < 0 || r.off == r.size) {
+			return n, err
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if rerr := r.resume(err); rerr != nil {
+			return n, rerr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the broken body by the rest of the image from r.off.
+func (r *resumeReader) resume(cause error) error {
+	r.body.Close()
+	r.failures++
+	if r.failures > fetchAttempts {
+		return fmt.Errorf("GET %s: %s at offset %d after %d resumes", r.url, cause, r.off, fetchAttempts)
+	}
+	fmt.Printf("resume %s at offset %d: %s\n", r.url, r.off, cause)
+
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.off))
+	if r.validator != "" {
+		req.Header.Set("If-Range", r.validator)
+	}
+	res, err := fetchDo(r.client, req, fetchAttempts)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusPartialContent || !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", r.off)) {
+		res.Body.Close()
+		return fmt.Errorf("GET %s: %s at offset %d, server can not resume: %s", r.url, cause, r.off, res.Status)
+	}
+	r.body = res.Body
+	return nil
+}
+
+func (r *resumeReader) Close() error {
+	return r.body.Close()
+}
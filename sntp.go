@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/vtolstov/go-ioctl"
+)
+
+const (
+	sntpTimeout = 3 * time.Second
+
+	// seconds between the ntp era 1900 and the unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+var (
+	// clockOffset is the correction applied to the system clock, reported
+	// with every install log message once the clock is synced.
+	clockOffset time.Duration
+	clockSynced bool
+)
+
+// rtcTime is struct rtc_time of linux/rtc.h.
+type rtcTime struct {
+	Sec, Min, Hour, Mday, Mon, Year, Wday, Yday, Isdst int32
+}
+
+func ntpTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(sec, frac*1e9>>32)
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:8], uint32(int64(t.Nanosecond())<<32/1e9))
+}
+
+// sntpServers returns the servers given with ntp= followed by those from
+// dhcp option 42.
+func sntpServers() []string {
+	var servers []string
+	for _, value := range cmdlineVars("ntp") {
+		servers = append(servers, splitList(value)...)
+	}
+	for _, ip := range ntpServers {
+		servers = append(servers, ip.String())
+	}
+	return servers
+}
+
+// sntpQuery asks server for the time and returns the offset of the local
+// clock as in RFC 4330.
+func sntpQuery(server string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(strings.Trim(server, "[]"), "123"), sntpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sntpTimeout))
+
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3 // version 4, client
+	t1 := time.Now()
+	putNTPTime(req[40:48], t1)
+	if _, err = conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	res := make([]byte, 48)
+	for {
+		n, err := conn.Read(res)
+		if err != nil {
+			return 0, err
+		}
+		t4 := time.Now()
+		if n < 48 || string(res[24:32]) != string(req[40:48]) {
+			continue
+		}
+		if mode := res[0] & 0x7; mode != 4 && mode != 5 {
+			return 0, fmt.Errorf("sntp %s: unexpected mode %d", server, mode)
+		}
+		if res[1] == 0 {
+			return 0, fmt.Errorf("sntp %s: kiss of death %s", server, res[12:16])
+		}
+		if res[0]>>6 == 3 {
+			return 0, fmt.Errorf("sntp %s: server clock not synchronized", server)
+		}
+		t2 := ntpTime(res[32:40])
+		t3 := ntpTime(res[40:48])
+		return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+	}
+}
+
+// syncClock sets the system clock from the first sntp server answering, and
+// the hardware clock too with the ntp-rtc parameter.
+func syncClock() error {
+	servers := sntpServers()
+	if len(servers) == 0 {
+		return fmt.Errorf("no ntp servers")
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		offset, err := sntpQuery(server)
+		if err != nil {
+			if debug {
+				fmt.Printf("sntp %s: %s\n", server, err)
+			}
+			lastErr = err
+			continue
+		}
+
+		now := time.Now().Add(offset)
+		tv := syscall.NsecToTimeval(now.UnixNano())
+		if err = syscall.Settimeofday(&tv); err != nil {
+			return fmt.Errorf("set clock err: %s", err)
+		}
+		clockOffset = offset
+		clockSynced = true
+		fmt.Printf("clock set from %s, offset %s\n", server, offset)
+
+		if cmdlineBool("ntp-rtc") {
+			if err = setRTC(now); err != nil {
+				fmt.Printf("set rtc err: %s\n", err)
+			}
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// setRTC writes t to the hardware clock in UTC.
+func setRTC(t time.Time) error {
+	f, err := os.Open("/dev/rtc0")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	t = t.UTC()
+	rtc := rtcTime{
+		Sec:  int32(t.Second()),
+		Min:  int32(t.Minute()),
+		Hour: int32(t.Hour()),
+		Mday: int32(t.Day()),
+		Mon:  int32(t.Month()) - 1,
+		Year: int32(t.Year()) - 1900,
+		Wday: int32(t.Weekday()),
+		Yday: int32(t.YearDay()) - 1,
+	}
+	return ioctl.IOCTL(f.Fd(), ioctl.IOW('p', 0x0a, unsafe.Sizeof(rtc)), uintptr(unsafe.Pointer(&rtc)))
+}
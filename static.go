@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ipParam is a parsed dracut style ip= kernel parameter:
+//
+//	ip=<autoconf>
+//	ip=<iface>:<autoconf>
+//	ip=<client-ip>:[<peer>]:<gw-ip>:<netmask>:<hostname>:<iface>:<autoconf>[:[<mtu>][:<macaddr>]]
+//	ip=<client-ip>:[<peer>]:<gw-ip>:<netmask>:<hostname>:<iface>:<autoconf>[:[<dns1>][:<dns2>]]
+//
+// ipv6 addresses must be enclosed in brackets.
+type ipParam struct {
+	IP       net.IP
+	Peer     net.IP
+	Gateway  net.IP
+	Mask     net.IPMask
+	Hostname string
+	Iface    string
+	Mode     string
+	MTU      int
+	MAC      net.HardwareAddr
+	DNS      []net.IP
+}
+
+// splitIPParam splits s on colons that are not inside brackets.
+func splitIPParam(s string) ([]string, error) {
+	var fields []string
+	var field []byte
+	bracket := false
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '[' && !bracket:
+			bracket = true
+		case s[i] == ']' && bracket:
+			bracket = false
+		case s[i] == ':' && !bracket:
+			fields = append(fields, string(field))
+			field = nil
+		default:
+			field = append(field, s[i])
+		}
+	}
+	if bracket {
+		return nil, fmt.Errorf("unbalanced brackets in ip=%s", s)
+	}
+	return append(fields, string(field)), nil
+}
+
+func parseParamIP(name string, s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid %s address %s", name, s)
+	}
+	return ip, nil
+}
+
+func parseNetmask(s string, ip net.IP) (net.IPMask, error) {
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+
+	if s == "" {
+		// the classful mask like the kernel ip= parameter, ipv6 has none
+		// and gets the /64 of slaac
+		if bits == 32 {
+			return ip.DefaultMask(), nil
+		}
+		return net.CIDRMask(64, bits), nil
+	}
+
+	if m := net.ParseIP(s); m != nil {
+		if m.To4() == nil || bits != 32 {
+			return nil, fmt.Errorf("invalid netmask %s for %s", s, ip)
+		}
+		mask := net.IPMask(m.To4())
+		if ones, _ := mask.Size(); ones == 0 && !m.Equal(net.IPv4zero) {
+			return nil, fmt.Errorf("non contiguous netmask %s", s)
+		}
+		return mask, nil
+	}
+
+	ones, err := strconv.Atoi(s)
+	if err != nil || ones < 0 || ones > bits {
+		return nil, fmt.Errorf("invalid netmask %s for %s", s, ip)
+	}
+	return net.CIDRMask(ones, bits), nil
+}
+
+func parseIPParam(s string) (*ipParam, error) {
+	fields, err := splitIPParam(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ipParam{}
+	switch {
+	case len(fields) == 1:
+		p.Mode = fields[0]
+		return p, nil
+	case len(fields) == 2:
+		p.Iface = fields[0]
+		p.Mode = fields[1]
+		return p, nil
+	case len(fields) < 7:
+		return nil, fmt.Errorf("invalid ip=%s", s)
+	}
+
+	if p.IP, err = parseParamIP("client", fields[0]); err != nil {
+		return nil, err
+	}
+	if p.Peer, err = parseParamIP("peer", fields[1]); err != nil {
+		return nil, err
+	}
+	if p.Gateway, err = parseParamIP("gateway", fields[2]); err != nil {
+		return nil, err
+	}
+	if p.IP != nil {
+		if p.Mask, err = parseNetmask(fields[3], p.IP); err != nil {
+			return nil, err
+		}
+		for _, ip := range []net.IP{p.Peer, p.Gateway} {
+			if ip != nil && (ip.To4() == nil) != (p.IP.To4() == nil) {
+				return nil, fmt.Errorf("address family mismatch between %s and %s", p.IP, ip)
+			}
+		}
+	}
+	p.Hostname = fields[4]
+	p.Iface = fields[5]
+	p.Mode = fields[6]
+
+	rest := fields[7:]
+	if len(rest) > 0 && rest[0] != "" {
+		if mtu, err := strconv.Atoi(rest[0]); err == nil {
+			p.MTU = mtu
+		} else if ns := net.ParseIP(rest[0]); ns != nil {
+			p.DNS = append(p.DNS, ns)
+		} else {
+			return nil, fmt.Errorf("invalid mtu or dns %s in ip=%s", rest[0], s)
+		}
+	}
+	if len(rest) > 1 && rest[1] != "" {
+		if ns := net.ParseIP(rest[1]); ns != nil {
+			p.DNS = append(p.DNS, ns)
+		} else if p.MAC, err = net.ParseMAC(strings.Join(rest[1:], ":")); err != nil {
+			return nil, fmt.Errorf("invalid macaddr or dns %s in ip=%s", rest[1], s)
+		}
+	}
+	return p, nil
+}
+
+// static reports whether the parameter asks for a fixed address without any
+// autoconfiguration.
+func (p *ipParam) static() bool {
+	if p.IP == nil {
+		return false
+	}
+	switch p.Mode {
+	case "", "none", "off", "static":
+		return true
+	}
+	return false
+}
+
+func (p *ipParam) link() (netlink.Link, error) {
+	if p.Iface != "" {
+		return netlink.LinkByName(p.Iface)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if p.MAC != nil && attrs.HardwareAddr.String() == p.MAC.String() {
+			return link, nil
+		}
+		if p.MAC == nil && attrs.Flags&net.FlagLoopback == 0 {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("no interface found for ip=%s", p.IP)
+}
+
+// networkStatic applies static ip= parameters via netlink, together with any
+// nameserver= parameters.
+func networkStatic(params []*ipParam) error {
+	var nameservers []net.IP
+	has4 := false
+	has6 := false
+
+	for _, p := range params {
+		link, err := p.link()
+		if err != nil {
+			return err
+		}
+		ifname := link.Attrs().Name
+		exit_fail(networkIfacesUp([]string{ifname}))
+		if netIface == "" {
+			netIface = ifname
+		}
+
+		if p.MAC != nil {
+			if err = netlink.LinkSetHardwareAddr(link, p.MAC); err != nil {
+				return fmt.Errorf("set mac %s on %s err: %s", p.MAC, ifname, err)
+			}
+		}
+		if p.MTU > 0 {
+			if err = netlink.LinkSetMTU(link, p.MTU); err != nil {
+				return fmt.Errorf("set mtu %d on %s err: %s", p.MTU, ifname, err)
+			}
+		}
+
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: p.IP, Mask: p.Mask}}
+		if debug {
+			fmt.Printf("set addr %s on %s\n", addr.IPNet, ifname)
+		}
+		if err = netlink.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("addr add %s err: %s", addr.IPNet, err)
+		}
+
+		if p.Peer != nil {
+			bits := 128
+			if p.Peer.To4() != nil {
+				bits = 32
+			}
+			r := &netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       &net.IPNet{IP: p.Peer, Mask: net.CIDRMask(bits, bits)},
+			}
+			if err = netlink.RouteAdd(r); err != nil && err != syscall.EEXIST {
+				return fmt.Errorf("route to peer %s err: %s", p.Peer, err)
+			}
+		}
+
+		if p.Gateway != nil && !p.Gateway.IsUnspecified() {
+			if debug {
+				fmt.Printf("set default route to %s\n", p.Gateway)
+			}
+			r := &netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       &net.IPNet{},
+				Gw:        p.Gateway,
+			}
+			if err = netlink.RouteAdd(r); err != nil && err != syscall.EEXIST {
+				return fmt.Errorf("default route via %s err: %s", p.Gateway, err)
+			}
+		}
+
+		if p.IP.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+			for i := 0; i < 50 && !inet6Ready(ifname, "00"); i++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+
+		if p.Hostname != "" {
+			if err = syscall.Sethostname([]byte(p.Hostname)); err != nil {
+				fmt.Printf("set hostname %s err: %s\n", p.Hostname, err)
+			}
+		}
+		nameservers = append(nameservers, p.DNS...)
+	}
+
+	for _, value := range cmdlineVars("nameserver") {
+		ns := net.ParseIP(strings.Trim(value, "[]"))
+		if ns == nil {
+			return fmt.Errorf("invalid nameserver=%s", value)
+		}
+		nameservers = append(nameservers, ns)
+	}
+	if len(nameservers) > 0 {
+		exit_fail(writeResolvConf(nameservers, nil))
+	}
+
+	// an installer with both families configured must not filter addresses
+	ipv4 = has4 && !has6
+	ipv6 = has6 && !has4
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetmask(t *testing.T) {
+	for _, tt := range []struct {
+		mask, ip string
+		want     int
+	}{
+		{"", "10.1.2.3", 8},
+		{"", "172.16.0.5", 16},
+		{"", "192.168.1.10", 24},
+		{"", "2001:db8::10", 64},
+		{"255.255.255.128", "192.168.1.10", 25},
+		{"20", "10.1.2.3", 20},
+		{"48", "2001:db8::10", 48},
+		{"255.0.255.0", "10.1.2.3", -1},
+		{"255.255.255.0", "2001:db8::10", -1},
+		{"33", "10.1.2.3", -1},
+	} {
+		mask, err := parseNetmask(tt.mask, net.ParseIP(tt.ip))
+		if tt.want < 0 {
+			if err == nil {
+				t.Errorf("parseNetmask(%q, %s) = %s, want error", tt.mask, tt.ip, mask)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseNetmask(%q, %s): %s", tt.mask, tt.ip, err)
+			continue
+		}
+		if ones, _ := mask.Size(); ones != tt.want {
+			t.Errorf("parseNetmask(%q, %s) = /%d, want /%d", tt.mask, tt.ip, ones, tt.want)
+		}
+	}
+}
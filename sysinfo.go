@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+)
+
+const dmiPath = "/sys/class/dmi/id/"
+
+// machineArch returns the kernel machine name like x86_64 or i686.
+func machineArch() string {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return ""
+	}
+	var buf []byte
+	for _, c := range uts.Machine {
+		if c == 0 {
+			break
+		}
+		buf = append(buf, byte(c))
+	}
+	return string(buf)
+}
+
+// dmiValue reads a smbios field exported by the kernel, empty if missing.
+func dmiValue(name string) string {
+	buf, err := ioutil.ReadFile(dmiPath + name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(buf))
+}
+
+// productUUID returns the smbios system uuid in its canonical text form.
+func productUUID() string {
+	return strings.ToLower(dmiValue("product_uuid"))
+}
+
+// productSerial returns the smbios system serial number.
+func productSerial() string {
+	return dmiValue("product_serial")
+}
+
+// parseUUID converts a textual uuid to its 16 bytes.
+func parseUUID(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("invalid uuid %s", s)
+	}
+	return b, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CA bundle built into the initrd
+const caBundleFile = "/etc/ssl/certs/ca-certificates.crt"
+
+// tlsPin is the sha256 of the server certificate or of its public key info,
+// never of a CA.
+type tlsPin struct {
+	spki bool
+	hash []byte
+}
+
+// tlsPins parses the tls-pin= parameters, sha256//<base64> for the hash of
+// the public key like curl --pinnedpubkey or the hex sha256 fingerprint of
+// the certificate.
+func tlsPins() ([]tlsPin, error) {
+	var pins []tlsPin
+	for _, value := range cmdlineVars("tls-pin") {
+		for _, s := range strings.Split(value, ",") {
+			var pin tlsPin
+			var err error
+			if strings.HasPrefix(s, "sha256//") {
+				pin.spki = true
+				pin.hash, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "sha256//"))
+			} else {
+				pin.hash, err = hex.DecodeString(strings.Replace(s, ":", "", -1))
+			}
+			if err != nil || len(pin.hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid tls-pin %s", s)
+			}
+			pins = append(pins, pin)
+		}
+	}
+	return pins, nil
+}
+
+func (p tlsPin) match(cert *x509.Certificate) bool {
+	var sum [sha256.Size]byte
+	if p.spki {
+		sum = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	} else {
+		sum = sha256.Sum256(cert.Raw)
+	}
+	return bytes.Equal(sum[:], p.hash)
+}
+
+// tlsMode describes how server certificates are verified: pinned, ca or
+// insecure when asked for with the insecure parameter.
+func tlsMode() string {
+	switch {
+	case cmdlineBool("insecure"):
+		return "insecure"
+	case len(cmdlineVars("tls-pin")) > 0:
+		return "pinned"
+	}
+	return "ca"
+}
+
+// caRoots returns the certificates of the initrd CA bundle, nil to use the
+// system roots if there is none.
+func caRoots() *x509.CertPool {
+	buf, err := ioutil.ReadFile(caBundleFile)
+	if err != nil {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(buf) {
+		fmt.Printf("no certificates in %s\n", caBundleFile)
+		return nil
+	}
+	return roots
+}
+
+// newHTTPTransport returns the transport shared by config, log and image
+// requests. Servers are verified against the CA bundle, or their own
+// certificate against the tls-pin= hashes alone if given, which allows self
+// signed certificates. Requests go through the http proxy if any, https ones
+// tunneled with CONNECT so the verification above still applies.
+func newHTTPTransport(proxy string) *http.Transport {
+	proxyURL, proxyErr := parseProxy(proxy)
+	mode := tlsMode()
+	pins, err := tlsPins()
+	if err != nil {
+		fmt.Printf("%s\n", err)
+	}
+	roots := caRoots()
+	certs := clientCertificates()
+	config := func(host string) *tls.Config {
+		return &tls.Config{
+			ServerName:         host,
+			RootCAs:            roots,
+			Certificates:       certs,
+			InsecureSkipVerify: mode != "ca",
+		}
+	}
+
+	return &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			if proxyErr != nil {
+				return nil, proxyErr
+			}
+			if proxyURL == nil || req.URL.Scheme != "http" || noProxy(hostname(req.URL.Host)) {
+				return nil, nil
+			}
+			return proxyURL, nil
+		},
+		Dial: dialHost,
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			if mode == "pinned" && len(pins) == 0 {
+				return nil, fmt.Errorf("tls %s: no valid tls-pin", addr)
+			}
+			if proxyErr != nil {
+				return nil, proxyErr
+			}
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			var raw net.Conn
+			if proxyURL != nil && !noProxy(host) {
+				raw, err = dialProxy(proxyURL, network, addr)
+			} else {
+				raw, err = dialHost(network, addr)
+			}
+			if err != nil {
+				return nil, err
+			}
+			conn := tls.Client(raw, config(host))
+			if err = conn.Handshake(); err != nil {
+				raw.Close()
+				return nil, err
+			}
+			if mode != "pinned" {
+				return conn, nil
+			}
+			// only the leaf is pinned, anyone can send a known CA after it
+			if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+				for _, pin := range pins {
+					if pin.match(certs[0]) {
+						return conn, nil
+					}
+				}
+			}
+			conn.Close()
+			return nil, fmt.Errorf("tls %s: certificate does not match tls-pin", addr)
+		},
+	}
+}
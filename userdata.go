@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// includes and nested archives deeper than this are considered a loop
+const userdataMaxDepth = 10
+
+// userdataTypes maps the first line of a user-data part to its mime type
+// like cloud-init does, longer prefixes first.
+var userdataTypes = []struct {
+	prefix string
+	ctype  string
+}{
+	{"#include-once", "text/x-include-once-url"},
+	{"#include", "text/x-include-url"},
+	{"#cloud-config-archive", "text/cloud-config-archive"},
+	{"#cloud-config", "text/cloud-config"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#upstart-job", "text/upstart-job"},
+	{"#part-handler", "text/part-handler"},
+	{"#!", "text/x-shellscript"},
+	{"content-type: multipart", "multipart/mixed"},
+	{"mime-version:", "multipart/mixed"},
+}
+
+// userdataType guesses the mime type of buf, plain yaml without header is
+// taken as cloud-config.
+func userdataType(buf []byte) string {
+	if len(buf) > 2 && buf[0] == 0x1f && buf[1] == 0x8b {
+		return "application/x-gzip"
+	}
+	head := bytes.TrimLeft(buf, " \t\r\n")
+	if len(head) > 64 {
+		head = head[:64]
+	}
+	lower := strings.ToLower(string(head))
+	for _, t := range userdataTypes {
+		if strings.HasPrefix(lower, t.prefix) {
+			return t.ctype
+		}
+	}
+	return "text/cloud-config"
+}
+
+// parseUserdata decodes gzip, multipart mime, #include and
+// #cloud-config-archive user-data and merges the cloud-config parts in
+// order, later parts overriding the keys set by earlier ones. The result is
+// validated by validateCloudConfig.
+func parseUserdata(buf []byte) (cloudConfig CloudConfig, err error) {
+	parts, err := userdataParts("", buf, 0)
+	if err != nil {
+		return cloudConfig, err
+	}
+	if len(parts) == 0 {
+		return cloudConfig, fmt.Errorf("no cloud-config in user-data")
+	}
+	for i, part := range parts {
+		if err = yaml.Unmarshal(part, &cloudConfig); err != nil {
+			return cloudConfig, fmt.Errorf("cloud-config part %d: %s", i+1, err)
+		}
+	}
+	return cloudConfig, validateCloudConfig(parts, &cloudConfig)
+}
+
+// userdataParts returns the cloud-config documents found in buf of mime
+// type ctype, guessed from the content when empty.
+func userdataParts(ctype string, buf []byte, depth int) ([][]byte, error) {
+	if depth > userdataMaxDepth {
+		return nil, fmt.Errorf("user-data nested too deep")
+	}
+	if ctype == "" || ctype == "text/plain" || ctype == "text/x-not-multipart" {
+		ctype = userdataType(buf)
+	}
+
+	switch ctype {
+	case "application/x-gzip", "application/gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		if buf, err = ioutil.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("gunzip user-data: %s", err)
+		}
+		return userdataParts("", buf, depth+1)
+	case "multipart/mixed", "multipart/alternative":
+		msg, err := mail.ReadMessage(bytes.NewReader(buf))
+		if err != nil {
+			return nil, fmt.Errorf("mime user-data: %s", err)
+		}
+		return mimeParts(msg.Header, msg.Body, depth+1)
+	case "text/x-include-url", "text/x-include-once-url":
+		return includeParts(buf, depth+1)
+	case "text/cloud-config-archive":
+		return archiveParts(buf, depth+1)
+	case "text/cloud-config":
+		return [][]byte{buf}, nil
+	}
+	if debug {
+		fmt.Printf("skip user-data part %s\n", ctype)
+	}
+	return nil, nil
+}
+
+// mimeHeader is satisfied by the headers of a mail message and its parts.
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// mimeParts walks a mime message or part with header h and body r.
+func mimeParts(h mimeHeader, r io.Reader, depth int) ([][]byte, error) {
+	if depth > userdataMaxDepth {
+		return nil, fmt.Errorf("user-data nested too deep")
+	}
+	ctype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ctype = ""
+	}
+
+	if !strings.HasPrefix(ctype, "multipart/") {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(h.Get("Content-Transfer-Encoding"), "base64") {
+			if buf, err = base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(buf), nil))); err != nil {
+				return nil, fmt.Errorf("mime user-data part: %s", err)
+			}
+		}
+		return userdataParts(ctype, buf, depth)
+	}
+
+	var parts [][]byte
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mime user-data: %s", err)
+		}
+		found, err := mimeParts(p.Header, p, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, found...)
+	}
+}
+
+// includeParts fetches every url listed after #include, one per line.
+func includeParts(buf []byte, depth int) ([][]byte, error) {
+	var parts [][]byte
+	client := newHTTPClient(10 * time.Second)
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#include-once") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "#include-once"))
+		} else if strings.HasPrefix(line, "#include") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "#include"))
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if debug {
+			fmt.Printf("include user-data %s\n", line)
+		}
+		content, err := httpGet(client, line)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %s", line, err)
+		}
+		found, err := userdataParts("", content, depth)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, found...)
+	}
+	return parts, scanner.Err()
+}
+
+// archiveParts decodes a #cloud-config-archive, a yaml list of strings or
+// of maps with content and an optional type.
+func archiveParts(buf []byte, depth int) ([][]byte, error) {
+	var items []interface{}
+	if err := yaml.Unmarshal(buf, &items); err != nil {
+		return nil, fmt.Errorf("cloud-config-archive: %s", err)
+	}
+
+	var parts [][]byte
+	for i, item := range items {
+		var ctype, content string
+		switch item := item.(type) {
+		case string:
+			content = item
+		case map[interface{}]interface{}:
+			content, _ = item["content"].(string)
+			ctype, _ = item["type"].(string)
+		default:
+			return nil, fmt.Errorf("cloud-config-archive item %d: unexpected %T", i+1, item)
+		}
+		found, err := userdataParts(ctype, []byte(content), depth)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, found...)
+	}
+	return parts, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// architectures images are built for
+var knownArchs = map[string]bool{
+	"x86_64":  true,
+	"x86_32":  true,
+	"amd64":   true,
+	"i386":    true,
+	"i686":    true,
+	"aarch64": true,
+	"arm64":   true,
+}
+
+// configError is a cloud-config error at a position of the user-data, line
+// and column are 1 based and 0 if unknown.
+type configError struct {
+	Part   int
+	Line   int
+	Column int
+	Path   string
+	Msg    string
+}
+
+func (e *configError) Error() string {
+	var pos string
+	if e.Part > 0 {
+		pos = fmt.Sprintf("part %d ", e.Part)
+	}
+	if e.Line > 0 {
+		pos += fmt.Sprintf("line %d column %d", e.Line, e.Column)
+	}
+	if pos == "" {
+		return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", strings.TrimSpace(pos), e.Path, e.Msg)
+}
+
+type configErrors []*configError
+
+func (e configErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e configErrors) Len() int      { return len(e) }
+func (e configErrors) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e configErrors) Less(i, j int) bool {
+	if e[i].Part != e[j].Part {
+		return e[i].Part < e[j].Part
+	}
+	return e[i].Line < e[j].Line
+}
+
+// validateCloudConfig rejects keys unknown to Bootstrap in each of the
+// merged parts and invalid values in the result. Other keys are left to
+// cloud-init in the installed system.
+func validateCloudConfig(parts [][]byte, cloudConfig *CloudConfig) error {
+	var errs configErrors
+	part := func(i int) int {
+		if len(parts) > 1 {
+			return i + 1
+		}
+		return 0
+	}
+
+	for i, doc := range parts {
+		var v map[interface{}]interface{}
+		if err := yaml.Unmarshal(doc, &v); err != nil {
+			return err
+		}
+		b, ok := v["bootstrap"]
+		if !ok {
+			continue
+		}
+		for _, path := range unknownKeys(b, reflect.TypeOf(Bootstrap{}), []string{"bootstrap"}) {
+			line, column := yamlPosition(doc, path)
+			errs = append(errs, &configError{Part: part(i), Line: line, Column: column, Path: strings.Join(path, "."), Msg: "unknown key"})
+		}
+	}
+
+	// values are reported where the last part setting them has them
+	invalid := func(msg string, path ...string) {
+		e := &configError{Path: strings.Join(path, "."), Msg: msg}
+		for i := len(parts) - 1; i >= 0; i-- {
+			for p := path; len(p) > 0; p = p[:len(p)-1] {
+				if line, column := yamlPosition(parts[i], p); line > 0 {
+					e.Part, e.Line, e.Column = part(i), line, column
+					break
+				}
+			}
+			if e.Line > 0 {
+				break
+			}
+		}
+		errs = append(errs, e)
+	}
+
+	b := cloudConfig.Bootstrap
+	if b.Timeout != "" {
+		if _, err := time.ParseDuration(b.Timeout); err != nil {
+			invalid(fmt.Sprintf("invalid duration %q", b.Timeout), "bootstrap", "timeout")
+		}
+	}
+	if len(b.Fetch) == 0 {
+		invalid("no image url", "bootstrap", "fetch")
+	}
+	for i, u := range b.Fetch {
+		if strings.TrimSpace(u) == "" {
+			invalid("empty image url", "bootstrap", "fetch", strconv.Itoa(i))
+		}
+	}
+	if _, err := parseProxy(b.Proxy); err != nil {
+		invalid(err.Error(), "bootstrap", "proxy")
+	}
+	if !knownArchs[b.Arch] {
+		invalid(fmt.Sprintf("unknown arch %q", b.Arch), "bootstrap", "arch")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Stable(errs)
+	return errs
+}
+
+// unknownKeys returns the paths of the mapping keys in v that have no field
+// in the yaml tags of t.
+func unknownKeys(v interface{}, t reflect.Type, path []string) [][]string {
+	var unknown [][]string
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return unknownKeys(v, t.Elem(), path)
+	case reflect.Slice:
+		items, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			unknown = append(unknown, unknownKeys(item, t.Elem(), appendPath(path, strconv.Itoa(i)))...)
+		}
+	case reflect.Struct:
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			fields[name] = f.Type
+		}
+		for k, child := range m {
+			key := fmt.Sprintf("%v", k)
+			ft, ok := fields[key]
+			if !ok {
+				unknown = append(unknown, appendPath(path, key))
+				continue
+			}
+			unknown = append(unknown, unknownKeys(child, ft, appendPath(path, key))...)
+		}
+	}
+	return unknown
+}
+
+func appendPath(path []string, elem string) []string {
+	p := make([]string, len(path), len(path)+1)
+	copy(p, path)
+	return append(p, elem)
+}
+
+// yamlPosition returns the line and column of the key or sequence item at
+// path in a block style yaml document, or 0, 0 if it can not be found.
+func yamlPosition(doc []byte, path []string) (line, column int) {
+	lines := strings.Split(string(doc), "\n")
+	start, end := 0, len(lines)
+
+	for _, elem := range path {
+		if n, err := strconv.Atoi(elem); err == nil {
+			i, col := yamlItem(lines, start, end, n)
+			if i < 0 {
+				return 0, 0
+			}
+			line, column = i+1, col+1
+			start, end = i, yamlBlockEnd(lines, i, col+1, end)
+			continue
+		}
+		i, col := yamlKey(lines, start, end, elem)
+		if i < 0 {
+			return 0, 0
+		}
+		line, column = i+1, col+1
+		start, end = i+1, yamlBlockEnd(lines, i, col, end)
+	}
+	return line, column
+}
+
+// yamlContent returns the indentation and content of a line, skipping the
+// dash of a sequence item when item is set.
+func yamlContent(s string, item bool) (int, string) {
+	text := strings.TrimLeft(s, " ")
+	indent := len(s) - len(text)
+	for item && strings.HasPrefix(text, "- ") {
+		rest := strings.TrimLeft(text[1:], " ")
+		indent += len(text) - len(rest)
+		text = rest
+	}
+	return indent, text
+}
+
+func yamlBlank(text string) bool {
+	return text == "" || strings.HasPrefix(text, "#") || text == "---"
+}
+
+// yamlKey finds key among the keys of the mapping in lines[start:end], the
+// first key of the mapping gives its indentation.
+func yamlKey(lines []string, start, end int, key string) (int, int) {
+	indent := -1
+	for i := start; i < end; i++ {
+		col, text := yamlContent(lines[i], true)
+		if yamlBlank(text) {
+			continue
+		}
+		if indent < 0 {
+			indent = col
+		}
+		if col != indent {
+			continue
+		}
+		for _, k := range []string{key, `"` + key + `"`, "'" + key + "'"} {
+			if strings.HasPrefix(text, k+":") {
+				return i, col
+			}
+		}
+	}
+	return -1, 0
+}
+
+// yamlItem finds the nth item of the sequence in lines[start:end].
+func yamlItem(lines []string, start, end, n int) (int, int) {
+	indent := -1
+	for i := start; i < end; i++ {
+		col, text := yamlContent(lines[i], false)
+		if yamlBlank(text) || !strings.HasPrefix(text, "-") {
+			continue
+		}
+		if indent < 0 {
+			indent = col
+		}
+		if col != indent {
+			continue
+		}
+		if n == 0 {
+			return i, col
+		}
+		n--
+	}
+	return -1, 0
+}
+
+// yamlBlockEnd returns the line ending the value of the key or item on line
+// i at column col, a less indented line or a sibling at the same indent.
+func yamlBlockEnd(lines []string, i, col, end int) int {
+	for j := i + 1; j < end; j++ {
+		indent, text := yamlContent(lines[j], false)
+		if yamlBlank(text) {
+			continue
+		}
+		if indent < col || (indent == col && !strings.HasPrefix(text, "-")) {
+			return j
+		}
+	}
+	return end
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+const (
+	vhdCookie       = "conectix"
+	vhdSparseCookie = "cxsparse"
+
+	vhdSector     = 512
+	vhdFooterSize = 512
+
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+
+	vhdUnallocated = 0xffffffff
+)
+
+// vhdFooter holds the fields of the hard disk footer used here, big endian.
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	DiskGeometry       uint32
+	DiskType           uint32
+}
+
+// vhdDynamicHeader holds the fields of the dynamic disk header used here.
+type vhdDynamicHeader struct {
+	Cookie          [8]byte
+	DataOffset      uint64
+	TableOffset     uint64
+	HeaderVersion   uint32
+	MaxTableEntries uint32
+	BlockSize       uint32
+}
+
+type vhdBlock struct {
+	index int64
+	off   int64
+}
+
+type vhdBlocks []vhdBlock
+
+func (b vhdBlocks) Len() int           { return len(b) }
+func (b vhdBlocks) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b vhdBlocks) Less(i, j int) bool { return b[i].off < b[j].off }
+
+func parseVhdFooter(buf []byte) (vhdFooter, error) {
+	var f vhdFooter
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, &f)
+	if string(f.Cookie[:]) != vhdCookie {
+		return f, fmt.Errorf("vhd footer cookie %q", f.Cookie[:])
+	}
+	return f, nil
+}
+
+// writeVhd writes the vhd image in r to w. Dynamic images start with a copy
+// of the footer, fixed ones are raw data only followed by it, so they are
+// recognised by the comptype of the metadata alone.
+func writeVhd(r io.Reader, w io.WriterAt, progress io.Writer) error {
+	or := &offsetReader{r: r}
+	head := make([]byte, vhdFooterSize)
+	n, err := io.ReadFull(or, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("vhd: %s", err)
+	}
+	if n < vhdFooterSize || string(head[:len(vhdCookie)]) != vhdCookie {
+		return writeVhdFixed(io.MultiReader(bytes.NewReader(head[:n]), or), w, progress)
+	}
+
+	footer, err := parseVhdFooter(head)
+	if err != nil {
+		return err
+	}
+	switch footer.DiskType {
+	case vhdTypeDynamic:
+	case vhdTypeDifferencing:
+		return fmt.Errorf("differencing vhd images are not supported")
+	default:
+		return fmt.Errorf("vhd disk type %d not supported", footer.DiskType)
+	}
+	size := int64(footer.CurrentSize)
+
+	var hdr vhdDynamicHeader
+	if err = or.skipTo(int64(footer.DataOffset)); err != nil {
+		return fmt.Errorf("vhd dynamic header: %s", err)
+	}
+	buf := make([]byte, 1024)
+	if _, err = io.ReadFull(or, buf); err != nil {
+		return fmt.Errorf("vhd dynamic header: %s", err)
+	}
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, &hdr)
+	if string(hdr.Cookie[:]) != vhdSparseCookie {
+		return fmt.Errorf("vhd dynamic header cookie %q", hdr.Cookie[:])
+	}
+	blockSize := int64(hdr.BlockSize)
+	if blockSize == 0 || blockSize%vhdSector != 0 {
+		return fmt.Errorf("vhd block size %d", blockSize)
+	}
+
+	// block allocation table, blocks are read in the order of the file
+	if err = or.skipTo(int64(hdr.TableOffset)); err != nil {
+		return fmt.Errorf("vhd block table: %s", err)
+	}
+	bat := make([]byte, 4*int64(hdr.MaxTableEntries))
+	if _, err = io.ReadFull(or, bat); err != nil {
+		return fmt.Errorf("vhd block table: %s", err)
+	}
+	var blocks vhdBlocks
+	for i := 0; i < len(bat); i += 4 {
+		if sector := binary.BigEndian.Uint32(bat[i:]); sector != vhdUnallocated {
+			blocks = append(blocks, vhdBlock{int64(i / 4), int64(sector) * vhdSector})
+		}
+	}
+	sort.Sort(blocks)
+
+	// each block starts with a bitmap of its sectors, padded to a sector
+	sectors := blockSize / vhdSector
+	bitmap := make([]byte, (sectors/8+vhdSector-1)/vhdSector*vhdSector)
+	data := make([]byte, blockSize)
+	for _, b := range blocks {
+		if err = or.skipTo(b.off); err != nil {
+			return fmt.Errorf("vhd block %d: %s", b.index, err)
+		}
+		if _, err = io.ReadFull(or, bitmap); err != nil {
+			return fmt.Errorf("vhd block %d: %s", b.index, err)
+		}
+		if _, err = io.ReadFull(or, data); err != nil {
+			return fmt.Errorf("vhd block %d: %s", b.index, err)
+		}
+
+		// write the runs of sectors marked in the bitmap
+		base := b.index * blockSize
+		for s := int64(0); s < sectors; {
+			if bitmap[s/8]&(0x80>>uint(s%8)) == 0 {
+				s++
+				continue
+			}
+			e := s
+			for e < sectors && bitmap[e/8]&(0x80>>uint(e%8)) != 0 {
+				e++
+			}
+			if err = vhdWrite(w, progress, data[s*vhdSector:e*vhdSector], base+s*vhdSector, size); err != nil {
+				return err
+			}
+			s = e
+		}
+	}
+
+	// the checksum covers the whole file
+	_, err = io.Copy(ioutil.Discard, or)
+	return err
+}
+
+// writeVhdFixed writes the raw data of a fixed vhd image, holding back the
+// footer at its end.
+func writeVhdFixed(r io.Reader, w io.WriterAt, progress io.Writer) error {
+	buf := make([]byte, 1<<20+vhdFooterSize)
+	var off int64
+	held := 0
+	for {
+		n, err := io.ReadFull(r, buf[held:])
+		held += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		out := held - vhdFooterSize
+		if _, err = w.WriteAt(buf[:out], off); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress.Write(buf[:out])
+		}
+		off += int64(out)
+		held = copy(buf, buf[out:held])
+	}
+
+	if held < vhdFooterSize {
+		return fmt.Errorf("vhd footer missing")
+	}
+	out := held - vhdFooterSize
+	footer, err := parseVhdFooter(buf[out:held])
+	if err != nil {
+		return err
+	}
+	if footer.DiskType != vhdTypeFixed || int64(footer.CurrentSize) != off+int64(out) {
+		return fmt.Errorf("vhd footer of a type %d disk of %d bytes after %d bytes of data", footer.DiskType, footer.CurrentSize, off+int64(out))
+	}
+	if _, err = w.WriteAt(buf[:out], off); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress.Write(buf[:out])
+	}
+	return nil
+}
+
+// vhdWrite writes data at off, cut at the end of the disk.
+func vhdWrite(w io.WriterAt, progress io.Writer, data []byte, off, size int64) error {
+	if rest := size - off; int64(len(data)) > rest {
+		if rest <= 0 {
+			return nil
+		}
+		data = data[:rest]
+	}
+	if _, err := w.WriteAt(data, off); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress.Write(data)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func vhdTestFooter(typ uint32, size int64, dataOffset uint64) []byte {
+	f := vhdFooter{
+		FileFormatVersion: 0x00010000,
+		DataOffset:        dataOffset,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          typ,
+	}
+	copy(f.Cookie[:], vhdCookie)
+	buf := make([]byte, vhdFooterSize)
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &f)
+	copy(buf, b.Bytes())
+	return buf
+}
+
+// vhdTestDynamic builds a dynamic image of three 4096 byte blocks. Block 1
+// is stored before block 0, block 2 is not allocated, block 0 only has
+// sectors 0 and 2 in its bitmap and block 1 is cut at the end of the disk.
+func vhdTestDynamic() ([]byte, []byte) {
+	const blockSize = 4096
+	size := int64(2*blockSize - 1000)
+
+	img := vhdTestFooter(vhdTypeDynamic, size, vhdFooterSize)
+	hdr := vhdDynamicHeader{TableOffset: 1536, HeaderVersion: 0x00010000, MaxTableEntries: 3, BlockSize: blockSize}
+	copy(hdr.Cookie[:], vhdSparseCookie)
+	dyn := make([]byte, 1024)
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &hdr)
+	copy(dyn, b.Bytes())
+	img = append(img, dyn...)
+
+	bat := make([]byte, vhdSector)
+	binary.BigEndian.PutUint32(bat[0:], 13)
+	binary.BigEndian.PutUint32(bat[4:], 4)
+	binary.BigEndian.PutUint32(bat[8:], vhdUnallocated)
+	img = append(img, bat...)
+
+	block0 := testPattern(blockSize, 1)
+	block1 := testPattern(blockSize, 100)
+	bitmap := make([]byte, vhdSector)
+	bitmap[0] = 0xff
+	img = append(img, bitmap...)
+	img = append(img, block1...)
+	bitmap[0] = 0xa0
+	img = append(img, bitmap...)
+	img = append(img, block0...)
+	img = append(img, vhdTestFooter(vhdTypeDynamic, size, vhdFooterSize)...)
+
+	want := make([]byte, size)
+	copy(want, block0[:vhdSector])
+	copy(want[2*vhdSector:], block0[2*vhdSector:3*vhdSector])
+	copy(want[blockSize:], block1)
+	return img, want
+}
+
+func TestWriteVhdDynamic(t *testing.T) {
+	img, want := vhdTestDynamic()
+	d := &memDisk{}
+	var progress bytes.Buffer
+	if err := writeVhd(bytes.NewReader(img), d, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.buf, want) {
+		t.Errorf("disk differs")
+	}
+	if progress.Len() != 2*vhdSector+4096-1000 {
+		t.Errorf("progress %d bytes", progress.Len())
+	}
+}
+
+func TestWriteVhdFixed(t *testing.T) {
+	// more than the 1MB read at once, so the footer spans two reads
+	data := testPattern(1<<20+300, 7)
+	img := append(append([]byte(nil), data...), vhdTestFooter(vhdTypeFixed, int64(len(data)), 0xffffffffffffffff)...)
+	d := &memDisk{}
+	if err := writeVhd(bytes.NewReader(img), d, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.buf, data) {
+		t.Errorf("disk differs")
+	}
+
+	// the footer size must match the data
+	img = append(append([]byte(nil), data[:1000]...), vhdTestFooter(vhdTypeFixed, 2000, 0xffffffffffffffff)...)
+	if err := writeVhd(bytes.NewReader(img), &memDisk{}, nil); err == nil {
+		t.Errorf("footer of a different size accepted")
+	}
+	if err := writeVhd(bytes.NewReader(data[:1000]), &memDisk{}, nil); err == nil {
+		t.Errorf("image without footer accepted")
+	}
+}
+
+func TestWriteVhdDifferencing(t *testing.T) {
+	img, _ := vhdTestDynamic()
+	binary.BigEndian.PutUint32(img[60:64], vhdTypeDifferencing)
+	if err := writeVhd(bytes.NewReader(img), &memDisk{}, nil); err == nil {
+		t.Errorf("differencing image accepted")
+	}
+}
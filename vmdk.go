@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	vmdkMagic = "KDMV"
+
+	vmdkSector = 512
+
+	// header flags of streamOptimized extents
+	vmdkFlagCompressed = 1 << 16
+	vmdkFlagMarkers    = 1 << 17
+
+	vmdkCompressDeflate = 1
+
+	// metadata marker types
+	vmdkMarkerEOS    = 0
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+// vmdkHeader is the sparse extent header, little endian.
+type vmdkHeader struct {
+	Magic              [4]byte
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+}
+
+// writeVmdk writes the streamOptimized vmdk image in r to w. Every grain
+// in the stream carries its offset, the grain tables only list the same
+// and are skipped, so unallocated grains are never written.
+func writeVmdk(r io.Reader, w io.WriterAt, progress io.Writer) error {
+	or := &offsetReader{r: r}
+	var hdr vmdkHeader
+	sector := make([]byte, vmdkSector)
+	if _, err := io.ReadFull(or, sector); err != nil {
+		return fmt.Errorf("vmdk header: %s", err)
+	}
+	binary.Read(bytes.NewReader(sector), binary.LittleEndian, &hdr)
+
+	if string(hdr.Magic[:]) != vmdkMagic {
+		return fmt.Errorf("not a vmdk image")
+	}
+	if hdr.Flags&(vmdkFlagCompressed|vmdkFlagMarkers) != vmdkFlagCompressed|vmdkFlagMarkers || hdr.CompressAlgorithm != vmdkCompressDeflate {
+		return fmt.Errorf("only streamOptimized vmdk images are supported")
+	}
+	size := int64(hdr.Capacity) * vmdkSector
+	grainSize := int64(hdr.GrainSize) * vmdkSector
+	if grainSize == 0 {
+		return fmt.Errorf("vmdk grain size 0")
+	}
+
+	// the embedded descriptor is of no use here
+	if err := or.skipTo(int64(hdr.OverHead) * vmdkSector); err != nil {
+		return fmt.Errorf("vmdk header: %s", err)
+	}
+
+	grain := make([]byte, grainSize)
+	for {
+		if _, err := io.ReadFull(or, sector[:12]); err != nil {
+			return fmt.Errorf("vmdk marker at %d: %s", or.off, err)
+		}
+		val := int64(binary.LittleEndian.Uint64(sector[0:8]))
+		n := int64(binary.LittleEndian.Uint32(sector[8:12]))
+
+		if n == 0 {
+			// metadata marker, val is the number of sectors following it
+			if _, err := io.ReadFull(or, sector[12:]); err != nil {
+				return fmt.Errorf("vmdk marker at %d: %s", or.off, err)
+			}
+			switch binary.LittleEndian.Uint32(sector[12:16]) {
+			case vmdkMarkerEOS:
+				// the checksum covers the whole file
+				_, err := io.Copy(ioutil.Discard, or)
+				return err
+			case vmdkMarkerGT, vmdkMarkerGD, vmdkMarkerFooter:
+				if err := or.skipTo(or.off + val*vmdkSector); err != nil {
+					return fmt.Errorf("vmdk metadata at %d: %s", or.off, err)
+				}
+				continue
+			default:
+				return fmt.Errorf("vmdk unknown marker type %d at %d", binary.LittleEndian.Uint32(sector[12:16]), or.off)
+			}
+		}
+
+		// grain marker, val is the sector of the grain in the disk
+		start := or.off - 12
+		zr, err := zlib.NewReader(io.LimitReader(or, n))
+		if err != nil {
+			return fmt.Errorf("vmdk grain at %d: %s", start, err)
+		}
+		m, err := io.ReadFull(zr, grain)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("vmdk grain at %d: %s", start, err)
+		}
+		zr.Close()
+
+		// grains are padded to a sector
+		end := start + 12 + n
+		if err = or.skipTo((end + vmdkSector - 1) / vmdkSector * vmdkSector); err != nil {
+			return fmt.Errorf("vmdk grain at %d: %s", start, err)
+		}
+
+		off := val * vmdkSector
+		if rest := size - off; int64(m) > rest {
+			if rest < 0 {
+				return fmt.Errorf("vmdk grain at %d beyond the disk", start)
+			}
+			m = int(rest)
+		}
+		if _, err = w.WriteAt(grain[:m], off); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress.Write(grain[:m])
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+// vmdkMarker appends a metadata marker sector followed by sectors of zeros.
+func vmdkMarker(img []byte, typ uint32, sectors int) []byte {
+	m := make([]byte, vmdkSector*(1+sectors))
+	binary.LittleEndian.PutUint64(m[0:8], uint64(sectors))
+	binary.LittleEndian.PutUint32(m[12:16], typ)
+	return append(img, m...)
+}
+
+// vmdkGrain appends a grain marker for sector lba and the deflated data,
+// padded to a sector.
+func vmdkGrain(img []byte, lba uint64, data []byte) []byte {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(data)
+	zw.Close()
+	m := make([]byte, 12)
+	binary.LittleEndian.PutUint64(m[0:8], lba)
+	binary.LittleEndian.PutUint32(m[8:12], uint32(z.Len()))
+	img = append(img, m...)
+	img = append(img, z.Bytes()...)
+	if pad := len(img) % vmdkSector; pad != 0 {
+		img = append(img, make([]byte, vmdkSector-pad)...)
+	}
+	return img
+}
+
+// vmdkTestImage builds a streamOptimized image of 1024 byte grains over a
+// disk of 5 sectors. Grains come out of order, the one at sector 4 is cut
+// at the end of the disk and grain 1 is not allocated.
+func vmdkTestImage() ([]byte, []byte) {
+	hdr := vmdkHeader{
+		Version:           3,
+		Flags:             vmdkFlagCompressed | vmdkFlagMarkers,
+		Capacity:          5,
+		GrainSize:         2,
+		NumGTEsPerGT:      512,
+		GdOffset:          0xffffffffffffffff,
+		OverHead:          2,
+		CompressAlgorithm: vmdkCompressDeflate,
+	}
+	copy(hdr.Magic[:], vmdkMagic)
+	var h bytes.Buffer
+	binary.Write(&h, binary.LittleEndian, &hdr)
+	img := make([]byte, 2*vmdkSector)
+	copy(img, h.Bytes())
+
+	first := testPattern(1024, 1)
+	last := testPattern(1024, 50)
+	img = vmdkGrain(img, 4, last)
+	img = vmdkGrain(img, 0, first)
+	img = vmdkMarker(img, vmdkMarkerGT, 4)
+	img = vmdkMarker(img, vmdkMarkerGD, 1)
+	img = vmdkMarker(img, vmdkMarkerFooter, 1)
+	img = vmdkMarker(img, vmdkMarkerEOS, 0)
+
+	want := make([]byte, 5*vmdkSector)
+	copy(want, first)
+	copy(want[4*vmdkSector:], last)
+	return img, want
+}
+
+func TestWriteVmdk(t *testing.T) {
+	img, want := vmdkTestImage()
+	d := &memDisk{}
+	var progress bytes.Buffer
+	if err := writeVmdk(bytes.NewReader(img), d, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.buf, want) {
+		t.Errorf("disk differs")
+	}
+	if progress.Len() != 1024+512 {
+		t.Errorf("progress %d bytes", progress.Len())
+	}
+}
+
+func TestWriteVmdkRefused(t *testing.T) {
+	img, _ := vmdkTestImage()
+
+	// monolithicSparse, not compressed
+	bad := append([]byte(nil), img...)
+	binary.LittleEndian.PutUint32(bad[8:12], 1)
+	if err := writeVmdk(bytes.NewReader(bad), &memDisk{}, nil); err == nil {
+		t.Errorf("sparse extent accepted")
+	}
+
+	// no end of stream marker
+	if err := writeVmdk(bytes.NewReader(img[:len(img)-vmdkSector]), &memDisk{}, nil); err == nil {
+		t.Errorf("truncated image accepted")
+	}
+
+	// grain past the capacity
+	bad = vmdkGrain(append([]byte(nil), img[:2*vmdkSector]...), 6, testPattern(1024, 1))
+	bad = vmdkMarker(bad, vmdkMarkerEOS, 0)
+	if err := writeVmdk(bytes.NewReader(bad), &memDisk{}, nil); err == nil {
+		t.Errorf("grain beyond the disk accepted")
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+// Replacements for math/bits, which is missing before go1.9.
+
+func leadingZeros8(x uint8) int {
+	n := 0
+	for ; n < 8 && x&0x80 == 0; n++ {
+		x <<= 1
+	}
+	return n
+}
+
+func leadingZeros16(x uint16) int {
+	n := 0
+	for ; n < 16 && x&0x8000 == 0; n++ {
+		x <<= 1
+	}
+	return n
+}
+
+func leadingZeros32(x uint32) int {
+	n := 0
+	for ; n < 32 && x&0x80000000 == 0; n++ {
+		x <<= 1
+	}
+	return n
+}
+
+func rotateLeft64(x uint64, k uint) uint64 {
+	return x<<k | x>>(64-k)
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func makeSequence(start, n int) (seq []byte) {
+	for i := 0; i < n; i++ {
+		seq = append(seq, byte(start+i))
+	}
+	return
+}
+
+func TestWindow(t *testing.T) {
+	for size := 0; size <= 3; size++ {
+		for i := 0; i <= 2*size; i++ {
+			a := makeSequence('a', i)
+			for j := 0; j <= 2*size; j++ {
+				b := makeSequence('a'+i, j)
+				for k := 0; k <= 2*size; k++ {
+					c := makeSequence('a'+i+j, k)
+
+					testWindow(t, size, a, b, c)
+				}
+			}
+		}
+	}
+}
+
+// testWindow tests window by saving three sequences of bytes to it.
+// Third sequence tests read offset that can become non-zero only after second save.
+func testWindow(t *testing.T, size int, a, b, c []byte) {
+	var w window
+	w.reset(size)
+
+	w.save(a)
+	w.save(b)
+	w.save(c)
+
+	var tail []byte
+	tail = append(tail, a...)
+	tail = append(tail, b...)
+	tail = append(tail, c...)
+
+	if len(tail) > size {
+		tail = tail[len(tail)-size:]
+	}
+
+	if w.len() != uint32(len(tail)) {
+		t.Errorf("%d-%q-%q-%q: wrong data length: got: %d, want: %d", size, a, b, c, w.len(), len(tail))
+	}
+
+	var from, to uint32
+	for from = 0; from <= uint32(len(tail)); from++ {
+		for to = from; to <= uint32(len(tail)); to++ {
+			got := w.appendTo(nil, from, to)
+			want := tail[from:to]
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("%d-%q-%q-%q: wrong data at [%d:%d]: got %q, want %q", size, a, b, c, from, to, got, want)
+			}
+		}
+	}
+}
+
+// TestWindowGrow tests a window larger than the 1MB reset allocates up
+// front, as for frames compressed with --long.
+func TestWindowGrow(t *testing.T) {
+	var w window
+	w.reset(MaxWindowSize)
+	if cap(w.data) > 1<<20 {
+		t.Errorf("reset allocated %d bytes", cap(w.data))
+	}
+
+	const size = 2<<20 + 5
+	w.reset(size)
+	var all []byte
+	for i := 0; len(all) < 3<<20; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, 65521)
+		w.save(chunk)
+		all = append(all, chunk...)
+	}
+	tail := all[len(all)-size:]
+	if w.len() != size {
+		t.Fatalf("wrong data length: got: %d, want: %d", w.len(), size)
+	}
+	for _, r := range [][2]uint32{{0, size}, {0, 1}, {size - 1, size}, {1 << 20, 1<<20 + 70000}} {
+		if got := w.appendTo(nil, r[0], r[1]); !bytes.Equal(got, tail[r[0]:r[1]]) {
+			t.Errorf("wrong data at [%d:%d]", r[0], r[1])
+		}
+	}
+
+	// the grown buffer is reused
+	w.reset(16)
+	w.save([]byte("hello"))
+	if got := w.appendTo(nil, 0, w.len()); string(got) != "hello" {
+		t.Errorf("after reset got %q", got)
+	}
+}